@@ -6,4 +6,8 @@ type CloudantAccount struct {
 	Password string
 	Url      string
 	Cookie   string
+	ApiKey   string
+	Token    string
+	// from the app's CLOUDANT_SYNC_DBS environment variable, if set
+	Databases []string
 }
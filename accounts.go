@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"strconv"
+)
+
+/*
+*	Sets up replication between the Cloudant accounts listed in the
+*	config file passed with --config rather than the ones bound to an
+*	app, so no Bluemix login is needed. Returns false if any request
+*	failed along the way.
+ */
+func replicateAccounts(args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	setOutputMode(flags)
+	if flags.Config == "" {
+		bcr_utils.CheckErrorFatal(errors.New("Pass the accounts to replicate between with '" +
+			terminal.ColorizeBold("--config FILE", 33) + "'"))
+	}
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := ca.GetAccountsFromConfig(httpClient, flags.Config, flags.ApiKey)
+	bcr_utils.CheckErrorFatal(err)
+	cloudantAccounts = distinctAccounts(httpClient, cloudantAccounts, flags)
+	if len(cloudantAccounts) < 2 {
+		bcr_utils.CheckErrorNonFatal(errors.New("Replication requires at least two accounts, but '" + flags.Config + "' lists " +
+			strconv.Itoa(len(cloudantAccounts)) + ".\nNothing to replicate."))
+		endSessions(httpClient, cloudantAccounts, flags)
+		return false
+	}
+	checkRegions(cloudantAccounts, flags)
+	checkGrantAs(cloudantAccounts, flags)
+	dbs := newDatabases(selectDatabases(httpClient, cloudantAccounts, flags), httpClient, cloudantAccounts, flags)
+	if flags.NewOnly && len(dbs) == 0 {
+		endSessions(httpClient, cloudantAccounts, flags)
+		return true
+	}
+	plan := resumePlan(dbs, httpClient, cloudantAccounts, flags)
+	printEstimate(dbs, httpClient, cloudantAccounts, flags)
+	if !confirmPermissions(unshared(dbs, plan), cloudantAccounts, flags) {
+		endSessions(httpClient, cloudantAccounts, flags)
+		return true
+	}
+	// results.Success tells the same as the error
+	results, _ := bcr_replication.Resume(httpClient, cloudantAccounts, dbs, plan, syncOptions(flags))
+	var names []string
+	for i := 0; i < len(cloudantAccounts); i++ {
+		names = append(names, cloudantAccounts[i].Endpoint)
+	}
+	return finishRun(flags.Config, names, dbs, httpClient, cloudantAccounts, results, flags, func() {
+		accountsSummary(flags.Config, cloudantAccounts)
+	})
+}
+
+func accountsSummary(config string, cloudantAccounts []cam.CloudantAccount) {
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Fprintln(bcr_utils.Out, "\nReplication was attempted between the following accounts from '"+
+		terminal.ColorizeBold(config, 36)+"':\n")
+	for i := 0; i < len(cloudantAccounts); i++ {
+		fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36))
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,17 +11,29 @@ import (
 	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/prompts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"golang.org/x/time/rate"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var ENDPOINTS = []string{"https://api.ng.bluemix.net",
 	"https://api.au-syd.bluemix.net",
 	"https://api.eu-gb.bluemix.net"}
 
+// replaced in tests, which must neither prompt nor exit
+var (
+	getPassword = bcr_prompts.GetPassword
+	exit        = os.Exit
+)
+
 /*
 *	This is the struct implementing the interface defined by the core CLI. It can
 *	be found at  "github.com/cloudfoundry/cli/plugin/plugin.go"
@@ -42,267 +56,789 @@ type BCReplicatorPlugin struct{}
 *	1 should the plugin exits nonzero.
  */
 func (c *BCReplicatorPlugin) Run(cliConnection plugin.CliConnection, args []string) {
-	if args[0] == "cloudant-replicate" {
-		terminal.InitColorSupport()
-		var err error
-		loggedIn, _ := cliConnection.IsLoggedIn()
-		if !loggedIn || err != nil {
-			fmt.Println("Please log in first\n")
-			cliConnection.CliCommand("login")
+	if len(args) == 0 {
+		c.printCommands("No command was given.")
+		exit(1)
+		return
+	}
+	if args[0] != "CLI-MESSAGE-UNINSTALL" && bcr_utils.IsValid("--version", args[1:]) {
+		c.printVersion(cliConnection)
+		return
+	}
+	stop := bcr_utils.CancelOnInterrupt()
+	defer stop()
+	succeeded := true
+	switch args[0] {
+	case "cloudant-replicate":
+		succeeded = replicate(cliConnection, args)
+	case "cloudant-unreplicate":
+		succeeded = unreplicate(cliConnection, args)
+	case "cloudant-replication-status":
+		succeeded = replicationStatus(cliConnection, args)
+	case "cloudant-replication-check":
+		succeeded = checkReplication(cliConnection, args)
+	case "cloudant-replication-monitor":
+		succeeded = monitorReplication(cliConnection, args)
+	case "cloudant-replicate-accounts":
+		succeeded = replicateAccounts(args)
+	case "CLI-MESSAGE-UNINSTALL":
+		// sent by "cf uninstall-plugin"; --report files are the user's own
+		succeeded = !bcr_utils.CheckErrorNonFatal(ca.RemoveCache())
+	default:
+		c.printCommands("Unknown command '" + args[0] + "'.")
+		succeeded = false
+	}
+	// commands return before exiting so their deferred login still runs
+	if bcr_utils.Ctx.Err() == context.DeadlineExceeded {
+		exit(1)
+	} else if bcr_utils.Ctx.Err() != nil {
+		exit(130)
+	} else if !succeeded {
+		exit(1)
+	}
+}
+
+/*
+*	Prints the version of the plugin along with those of the cf CLI
+*	and the Cloud Controller API it talks to, for bug reports
+ */
+func (c *BCReplicatorPlugin) printVersion(cliConnection plugin.CliConnection) {
+	metadata := c.GetMetadata()
+	fmt.Println(metadata.Name + " " + strconv.Itoa(metadata.Version.Major) + "." + strconv.Itoa(metadata.Version.Minor) + "." +
+		strconv.Itoa(metadata.Version.Build))
+	cliVersion := "unknown"
+	if output, err := cliConnection.CliCommandWithoutTerminalOutput("version"); err == nil && len(output) > 0 {
+		cliVersion = strings.TrimPrefix(strings.TrimSpace(output[0]), "cf version ")
+	}
+	fmt.Println("cf CLI " + cliVersion)
+	if apiVersion, err := cliConnection.ApiVersion(); err == nil && apiVersion != "" {
+		fmt.Println("Cloud Controller API " + apiVersion)
+	}
+}
+
+/*
+*	Reports problem along with the commands the plugin provides
+ */
+func (c *BCReplicatorPlugin) printCommands(problem string) {
+	var names []string
+	commands := c.GetMetadata().Commands
+	for i := 0; i < len(commands); i++ {
+		names = append(names, terminal.ColorizeBold(commands[i].Name, 36))
+	}
+	bcr_utils.CheckErrorNonFatal(errors.New(problem + " The available commands are " + strings.Join(names, ", ") +
+		".\nFor help look to '" + terminal.ColorizeBold("cf help COMMAND", 33) + "'"))
+}
+
+/*
+*	Sets up continuous replication for the selected databases
+*	between the Cloudant accounts bound to the app in every region.
+*	Returns false if any request failed along the way.
+ */
+func replicate(cliConnection plugin.CliConnection, args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password, endpoints := setup(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	if flags.Owner == "" {
+		flags.Owner = username
+	}
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := getCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+	bcr_utils.CheckErrorFatal(err)
+	if len(cloudantAccounts) < 2 {
+		bcr_utils.CheckErrorNonFatal(errors.New("Multi-region sync requires the app to be deployed in at least two regions, but a Cloudant service was only found in " +
+			strconv.Itoa(len(cloudantAccounts)) + ".\nNothing to replicate."))
+		endSessions(httpClient, cloudantAccounts, flags)
+		return false
+	}
+	checkRegions(cloudantAccounts, flags)
+	checkGrantAs(cloudantAccounts, flags)
+	dbs := newDatabases(selectDatabases(httpClient, cloudantAccounts, flags), httpClient, cloudantAccounts, flags)
+	if flags.NewOnly && len(dbs) == 0 {
+		endSessions(httpClient, cloudantAccounts, flags)
+		return true
+	}
+	plan := resumePlan(dbs, httpClient, cloudantAccounts, flags)
+	printEstimate(dbs, httpClient, cloudantAccounts, flags)
+	if !confirmPermissions(unshared(dbs, plan), cloudantAccounts, flags) {
+		endSessions(httpClient, cloudantAccounts, flags)
+		return true
+	}
+	// results.Success tells the same as the error
+	results, _ := bcr_replication.Resume(httpClient, cloudantAccounts, dbs, plan, syncOptions(flags))
+	return finishRun(appname, endpoints, dbs, httpClient, cloudantAccounts, results, flags, func() {
+		finalSummary(appname, endpoints, cloudantAccounts)
+	})
+}
+
+/*
+*	Ends the sessions of a finished run, adds how that went to results
+*	and reports the results: appended to the --report file, and printed
+*	as the --json summary, the single --quiet line, or what summary
+*	prints followed by the replication table. With --wait, first waits
+*	for the replications to be triggered or completed, which fails the
+*	run when they are not. Returns whether every step of the run
+*	succeeded.
+ */
+func finishRun(name string, endpoints []string, dbs []string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, results bcr_replication.Report,
+	flags bcr_utils.Flags, summary func()) bool {
+	if flags.Wait && !flags.DryRun && !flags.OnlyPermissions {
+		results.Success = watchReplicationStates(dbs, httpClient, cloudantAccounts, flags) && results.Success
+	}
+	sessions := endSessions(httpClient, cloudantAccounts, flags)
+	results.Sessions = bcr_replication.ToRequestResults(sessions)
+	results.Success = results.Success && !bcr_replication.HasErrors(sessions)
+	if flags.Report != "" {
+		writeReport(flags.Report, name, endpoints, cloudantAccounts, results)
+	}
+	if flags.Json {
+		printJsonSummary(name, endpoints, cloudantAccounts, results)
+	} else if flags.Quiet {
+		quietSummary(dbs, cloudantAccounts, results)
+	} else {
+		summary()
+		if !flags.OnlyPermissions && !flags.DryRun {
+			printReplicationTable(results.Databases, cloudantAccounts)
 		}
-		appname, dbs, password, all_dbs, create_dbs := bcr_utils.HandleFlags(args)
-		if appname == "" {
-			appname, err = bcr_prompts.GetAppName(cliConnection)
-			bcr_utils.CheckErrorNonFatal(err)
-			if err != nil {
-				cliConnection.CliCommand("login")
-				appname, err = bcr_prompts.GetAppName(cliConnection)
-				bcr_utils.CheckErrorFatal(err)
+	}
+	if flags.DryRun {
+		fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nDry run: no changes were made", 33))
+	}
+	return results.Success
+}
+
+/*
+*	Looks up the Cloudant accounts bound to appname in every endpoint,
+*	or to each of the apps passed with --apps. Apps bound to the same
+*	Cloudant service only contribute its account once.
+ */
+func getCloudantAccounts(cliConnection plugin.CliConnection, httpClient bcr_utils.Doer, endpoints []string, appname string, password string, flags bcr_utils.Flags) ([]cam.CloudantAccount, error) {
+	if len(flags.Apps) == 0 {
+		cloudantAccounts, err := getAppCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+		return distinctAccounts(httpClient, cloudantAccounts, flags), err
+	}
+	var cloudantAccounts []cam.CloudantAccount
+	for i := 0; i < len(flags.Apps); i++ {
+		appAccounts, err := getAppCloudantAccounts(cliConnection, httpClient, endpoints, flags.Apps[i], password, flags)
+		if err != nil {
+			return cloudantAccounts, err
+		}
+		for j := 0; j < len(appAccounts); j++ {
+			if hasAccount(cloudantAccounts, appAccounts[j]) {
+				fmt.Fprintln(bcr_utils.Out, "'"+terminal.ColorizeBold(flags.Apps[i], 36)+"' in '"+terminal.ColorizeBold(appAccounts[j].Endpoint, 36)+
+					"' is bound to a Cloudant service that was already found, skipping it\n")
+				endSessions(httpClient, appAccounts[j:j+1], flags)
+			} else {
+				cloudantAccounts = append(cloudantAccounts, appAccounts[j])
+			}
+		}
+	}
+	return cloudantAccounts, nil
+}
+
+/*
+*	Drops the accounts at the same url as an earlier one, e.g. the
+*	same Cloudant service bound in two regions, which would otherwise
+*	be set up to replicate into themselves
+ */
+func distinctAccounts(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []cam.CloudantAccount {
+	var distinct []cam.CloudantAccount
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if !hasAccount(distinct, cloudantAccounts[i]) {
+			distinct = append(distinct, cloudantAccounts[i])
+			continue
+		}
+		for j := 0; j < len(distinct); j++ {
+			if bcr_utils.GetApiUrl(distinct[j]) == bcr_utils.GetApiUrl(cloudantAccounts[i]) {
+				fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" '"+terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36)+
+					"' is the same Cloudant account as '"+terminal.ColorizeBold(distinct[j].Endpoint, 36)+"'. Skipping it so that it does not replicate into itself.")
 			}
+		}
+		endSessions(httpClient, cloudantAccounts[i:i+1], flags)
+	}
+	return distinct
+}
+
+/*
+*	Tells whether one of cloudantAccounts is the Cloudant
+*	account at the same url as account
+ */
+func hasAccount(cloudantAccounts []cam.CloudantAccount, account cam.CloudantAccount) bool {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if bcr_utils.GetApiUrl(cloudantAccounts[i]) == bcr_utils.GetApiUrl(account) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Looks up the Cloudant accounts bound to appname in every endpoint.
+*	With --cache, accounts discovered by an earlier run for the same
+*	target and app within the cache's lifetime are reused instead of
+*	logging in to every region.
+*	Accounts that can't be logged in to are an error, unless
+*	--allow-partial is passed to carry on without them.
+ */
+func getAppCloudantAccounts(cliConnection plugin.CliConnection, httpClient bcr_utils.Doer, endpoints []string, appname string, password string, flags bcr_utils.Flags) ([]cam.CloudantAccount, error) {
+	apiEndpoint, _, org, space := bcr_utils.GetCurrentTarget(cliConnection)
+	cacheKey := ca.CacheKey(apiEndpoint, org, space, appname)
+	if flags.Cache > 0 {
+		if cloudantAccounts, ok := ca.GetCachedCloudantAccounts(httpClient, endpoints, cacheKey, flags.ApiKey, flags.Cache); ok {
+			fmt.Fprintln(bcr_utils.Out, "Using the cached Cloudant credentials for '"+terminal.ColorizeBold(appname, 36)+"'\n")
+			return cloudantAccounts, nil
+		}
+	}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags.ApiKey,
+		time.Duration(flags.LoginTimeout)*time.Second)
+	if loginErrs, ok := err.(ca.LoginErrors); ok {
+		if !flags.AllowPartial {
+			endSessions(httpClient, cloudantAccounts, flags)
+			return nil, errors.New(loginErrs.Error() + "\nPass '" + terminal.ColorizeBold("--allow-partial", 33) +
+				"' to continue with the accounts that could be logged in to")
+		}
+		for i := 0; i < len(loginErrs); i++ {
+			fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" "+loginErrs[i].Error()+". Continuing without it.")
+		}
+		// a partial list must not be reused by later runs
+		return cloudantAccounts, nil
+	}
+	if err == nil && flags.Cache > 0 {
+		bcr_utils.CheckErrorNonFatal(ca.CacheCloudantAccounts(cacheKey, endpoints, cloudantAccounts))
+	}
+	return cloudantAccounts, err
+}
+
+/*
+*	Lists the permissions that are about to be granted and, unless
+*	--yes, --dry-run or --json is passed, asks the user to confirm them.
+*	There is nothing to confirm when --resume finds them all granted.
+ */
+func confirmPermissions(dbs []string, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	if flags.SkipPermissions || (flags.Resume && len(dbs) == 0) {
+		return true
+	}
+	ask := !flags.Yes && !flags.DryRun && !flags.Json
+	if ask {
+		// the user has to see what they are agreeing to, even with --quiet
+		printPermissionPlan(os.Stdout, dbs, cloudantAccounts, flags)
+	} else {
+		printPermissionPlan(bcr_utils.Out, dbs, cloudantAccounts, flags)
+	}
+	if ask && !bcr_prompts.Confirm("Grant these permissions and continue?") {
+		fmt.Fprintln(bcr_utils.Out, "Aborted, no changes were made")
+		return false
+	}
+	return true
+}
+
+/*
+*	Resolves the databases a command works on: those passed with -d,
+*	every database with --all-dbs, those listed in the app's
+*	CLOUDANT_SYNC_DBS variable, or the user's selection otherwise.
+*	Databases passed to --exclude, and system databases unless
+*	--include-system is set, are dropped.
+ */
+func selectDatabases(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []string {
+	var err error
+	dbs := flags.Dbs
+	if flags.AllDbs {
+		dbs = bcr_utils.GetAllDatabases(httpClient, listingAccounts(cloudantAccounts, flags))
+	} else if flags.Match != "" {
+		dbs = matchDatabases(flags.Match, bcr_utils.GetAllDatabases(httpClient, listingAccounts(cloudantAccounts, flags)), dbs)
+	} else if len(dbs) == 0 && len(appDatabases(cloudantAccounts)) > 0 {
+		dbs = appDatabases(cloudantAccounts)
+		fmt.Fprintln(bcr_utils.Out, "Using the databases in the app's CLOUDANT_SYNC_DBS: "+terminal.ColorizeBold(strings.Join(dbs, ","), 36)+"\n")
+	} else if len(dbs) == 0 {
+		dbs, err = bcr_prompts.GetDatabases(httpClient, listingAccounts(cloudantAccounts, flags))
+		bcr_utils.CheckErrorFatal(err)
+	}
+	var selected []string
+	for i := 0; i < len(dbs); i++ {
+		if bcr_utils.IsValid(dbs[i], flags.Exclude) || (strings.HasPrefix(dbs[i], "_") && !flags.IncludeSystem) {
+			fmt.Fprintln(bcr_utils.Out, "Skipping excluded database '"+terminal.ColorizeBold(dbs[i], 36)+"'")
 		} else {
-			apps, _ := bcr_utils.GetAllApps(cliConnection)
-			if !bcr_utils.IsValid(appname, apps) {
-				bcr_utils.CheckErrorFatal(errors.New(appname + " is not a valid app at at your current target.\n"))
+			selected = append(selected, dbs[i])
+		}
+	}
+	if flags.Match != "" {
+		if len(selected) == 0 {
+			bcr_utils.CheckErrorFatal(errors.New("No database matches '" + flags.Match + "'"))
+		}
+		fmt.Fprintln(bcr_utils.Out, "Databases selected with --match '"+flags.Match+"': "+terminal.ColorizeBold(strings.Join(selected, ","), 36)+"\n")
+	}
+	return selected
+}
+
+/*
+*	Returns the accounts whose databases are listed for --all-dbs,
+*	--match and the prompt: the one in the --list-from region, or
+*	every account, so that databases missing from some are not missed
+ */
+func listingAccounts(cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []cam.CloudantAccount {
+	if flags.ListFrom == "" {
+		return cloudantAccounts
+	}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if bcr_replication.InRegion(cloudantAccounts[i], flags.ListFrom) {
+			return cloudantAccounts[i : i+1]
+		}
+	}
+	bcr_utils.CheckErrorFatal(errors.New("--list-from '" + flags.ListFrom + "' is not one of the regions found"))
+	return nil
+}
+
+/*
+*	Adds the databases in all_dbs whose names match the glob pattern,
+*	e.g. app_*, to dbs
+ */
+func matchDatabases(pattern string, all_dbs []string, dbs []string) []string {
+	matched := append([]string{}, dbs...)
+	for i := 0; i < len(all_dbs); i++ {
+		if ok, _ := path.Match(pattern, all_dbs[i]); ok && !bcr_utils.IsValid(all_dbs[i], matched) {
+			matched = append(matched, all_dbs[i])
+		}
+	}
+	return matched
+}
+
+/*
+*	Returns every database listed in CLOUDANT_SYNC_DBS by the app
+*	in any of the regions
+ */
+func appDatabases(cloudantAccounts []cam.CloudantAccount) []string {
+	var dbs []string
+	for i := 0; i < len(cloudantAccounts); i++ {
+		for j := 0; j < len(cloudantAccounts[i].Databases); j++ {
+			if !bcr_utils.IsValid(cloudantAccounts[i].Databases[j], dbs) {
+				dbs = append(dbs, cloudantAccounts[i].Databases[j])
 			}
 		}
-		if password == "" {
-			password = bcr_prompts.GetPassword()
+	}
+	return dbs
+}
+
+/*
+*	Lists which usernames shareDatabases will grant the --grant-roles
+*	to on each database, in each region.
+ */
+func printPermissionPlan(w io.Writer, dbs []string, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) {
+	fmt.Fprintln(w, "\nThe following accounts will be granted "+strings.Join(flags.GrantRoles, ", ")+":\n")
+	for i := 0; i < len(dbs); i++ {
+		for j := 0; j < len(cloudantAccounts); j++ {
+			var grantees []string
+			for k := 0; k < len(cloudantAccounts); k++ {
+				if bcr_replication.Replicates(cloudantAccounts[k], cloudantAccounts[j], flags) {
+					grantees = append(grantees, bcr_replication.Grantee(cloudantAccounts[k], flags))
+				}
+			}
+			fmt.Fprintln(w, "'"+terminal.ColorizeBold(dbs[i], 36)+"' in '"+terminal.ColorizeBold(cloudantAccounts[j].Endpoint, 36)+
+				"': "+strings.Join(grantees, ", "))
+		}
+	}
+}
+
+/*
+*	Switches the plugin's output over to machine-readable JSON
+*	when --json is passed and turns on request logging for -v.
+*	Every command calls this first, so it also starts the --deadline
+*	clock, applies --rps and turns colors off with --no-color or when
+*	stdout is not a terminal.
+ */
+func setOutputMode(flags bcr_utils.Flags) {
+	if flags.Json {
+		bcr_utils.Out, bcr_utils.Errors = ioutil.Discard, ioutil.Discard
+	} else if flags.Events {
+		// keep stdout to the events, one JSON object per line
+		bcr_utils.Out, bcr_utils.Errors, bcr_utils.Events = ioutil.Discard, os.Stderr, os.Stdout
+	} else if flags.Quiet {
+		bcr_utils.Out = ioutil.Discard
+	}
+	bcr_utils.Verbose = flags.Verbose
+	bcr_utils.ShowProgress = !flags.Quiet
+	bcr_utils.Colors = !flags.NoColor && !flags.Events && bcr_utils.IsTerminal(os.Stdout)
+	if !bcr_utils.Colors {
+		// read by InitColorSupport, the same as cf's own --no-color
+		terminal.UserAskedForColors = "false"
+	}
+	terminal.InitColorSupport()
+	if flags.Rps > 0 {
+		bcr_utils.Limiter = rate.NewLimiter(rate.Limit(flags.Rps), 1)
+	}
+	if flags.Deadline > 0 {
+		bcr_utils.SetDeadline(flags.Deadline)
+	}
+}
+
+/*
+*	Creates the http client shared by every request of a command,
+*	configured from the command line flags. Certificates are only
+*	left unchecked with --insecure.
+ */
+func newHttpClient(flags bcr_utils.Flags) *http.Client {
+	if flags.Insecure {
+		fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 31)+" --insecure is set: the certificates of the Cloudant servers "+
+			"are not verified, so the credentials sent to them can be intercepted. Only use it with test servers.\n")
+	}
+	httpClient := bcr_utils.NewHttpClient(&tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: flags.Insecure}, flags.Proxy)
+	httpClient.Timeout = time.Duration(flags.Timeout) * time.Second
+	return httpClient
+}
+
+/*
+*	The settings bcr_replication.Resume and DeleteCookies run with,
+*	taken from the command line flags
+ */
+func syncOptions(flags bcr_utils.Flags) bcr_replication.Options {
+	return bcr_replication.Options{
+		ReplicatorDb:      flags.ReplicatorDb,
+		IdPrefix:          flags.IdPrefix,
+		Create:            flags.Create,
+		DryRun:            flags.DryRun,
+		OnlyPermissions:   flags.OnlyPermissions,
+		SkipPermissions:   flags.SkipPermissions,
+		Verify:            flags.Verify,
+		CleanupOnFailure:  flags.CleanupOnFailure,
+		MaxRetries:        flags.MaxRetries,
+		Concurrency:       flags.Concurrency,
+		ParallelDbs:       flags.ParallelDbs,
+		ParallelAccounts:  flags.ParallelAccounts,
+		DbMap:             flags.DbMap,
+		GrantAs:           flags.GrantAs,
+		GrantRoles:        flags.GrantRoles,
+		Owner:             flags.Owner,
+		Topology:          flags.Topology,
+		Hub:               flags.Hub,
+		SourceRegion:      flags.SourceRegion,
+		Once:              flags.Once,
+		PushOnce:          flags.PushOnce,
+		PullOnce:          flags.PullOnce,
+		Filter:            flags.Filter,
+		PushFilter:        flags.PushFilter,
+		PullFilter:        flags.PullFilter,
+		QueryParams:       flags.QueryParams,
+		NoDdocs:           flags.NoDdocs,
+		NoCheckpoints:     flags.NoCheckpoints,
+		SinceSeq:          flags.SinceSeq,
+		WorkerProcesses:   flags.WorkerProcesses,
+		ConnectionTimeout: flags.ConnectionTimeout,
+		ReplicatorOptions: flags.ReplicatorOptions,
+	}
+}
+
+/*
+*	Creates the client the Bluemix password is checked with. Unlike
+*	newHttpClient it ignores --insecure and --proxy, which are only
+*	meant for the Cloudant servers, so that the password is only ever
+*	sent to a login server whose certificate has been verified.
+ */
+func newLoginClient(flags bcr_utils.Flags) *http.Client {
+	loginClient := bcr_utils.NewHttpClient(nil, nil)
+	loginClient.Timeout = time.Duration(flags.Timeout) * time.Second
+	return loginClient
+}
+
+/*
+*	Makes sure the user is logged in and resolves the app name,
+*	password and endpoints shared by every command, prompting
+*	for whatever was not passed as a flag.
+ */
+func setup(cliConnection plugin.CliConnection, flags bcr_utils.Flags) (string, string, []string) {
+	setOutputMode(flags)
+	var err error
+	loggedIn, _ := cliConnection.IsLoggedIn()
+	if !loggedIn || err != nil {
+		fmt.Fprint(bcr_utils.Out, "Please log in first\n\n")
+		cliConnection.CliCommand("login")
+	}
+	appname, password := flags.AppName, flags.Password
+	endpoints, err := bcr_utils.FilterEndpoints(apiEndpoints(cliConnection, flags), flags.Regions)
+	bcr_utils.CheckErrorFatal(err)
+	if len(flags.Apps) > 0 {
+		// each app is usually only deployed in some of the regions,
+		// so they can't be checked against the current target
+		appname = strings.Join(flags.Apps, ",")
+	} else if flags.AppGuid != "" {
+		appname, err = bcr_utils.GetAppNameByGuid(cliConnection, flags.AppGuid)
+		bcr_utils.CheckErrorFatal(err)
+	} else if appname == "" {
+		appname, err = bcr_prompts.GetAppName(cliConnection)
+		bcr_utils.CheckErrorNonFatal(err)
+		if err != nil {
+			cliConnection.CliCommand("login")
+			appname, err = bcr_prompts.GetAppName(cliConnection)
+			bcr_utils.CheckErrorFatal(err)
+		}
+	} else {
+		apps, _ := bcr_utils.GetAllApps(cliConnection)
+		if !bcr_utils.IsValid(appname, apps) {
+			bcr_utils.CheckErrorFatal(errors.New(appname + " is not a valid app at at your current target.\n"))
 		}
-		startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
-		defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
-		var httpClient = &http.Client{}
-		cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	}
+	if password == "" && flags.PasswordStdin {
+		password, err = bcr_prompts.ReadPasswordFromStdin()
 		bcr_utils.CheckErrorFatal(err)
-		if all_dbs {
-			dbs = bcr_utils.GetAllDatabases(httpClient, cloudantAccounts)
-		} else if len(dbs) == 0 {
-			dbs, err = bcr_prompts.GetDatabases(httpClient, cloudantAccounts)
+	}
+	if password == "" {
+		password = os.Getenv("CLOUDANT_SYNC_PASSWORD")
+	}
+	prompted := false
+	if password == "" {
+		password = getPassword(flags.ConfirmPassword)
+		prompted = true
+	}
+	if prompted {
+		password = checkPassword(cliConnection, password, endpoints, flags)
+	}
+	return appname, password, endpoints
+}
+
+/*
+*	Tries a password typed at the prompt against the login server of
+*	every endpoint that is about to be logged in to, so that a typo can
+*	be typed again, up to three times, before any region is logged in
+*	to. The endpoints that turned it down are listed each time.
+ */
+func checkPassword(cliConnection plugin.CliConnection, password string, endpoints []string, flags bcr_utils.Flags) string {
+	_, username, _, _ := bcr_utils.GetCurrentTarget(cliConnection)
+	loginClient := newLoginClient(flags)
+	for attempt := 1; ; attempt++ {
+		rejected := rejectingEndpoints(loginClient, endpoints, username, password)
+		if len(rejected) == 0 {
+			return password
+		}
+		msg := "The password for '" + terminal.ColorizeBold(username, 36) + "' was rejected by:\n"
+		for i := 0; i < len(rejected); i++ {
+			msg += "\n" + terminal.ColorizeBold(rejected[i], 36)
+		}
+		err := errors.New(msg + "\n")
+		if attempt == 3 {
 			bcr_utils.CheckErrorFatal(err)
 		}
-		createDatabase("_replicator", httpClient, cloudantAccounts)
-		for i := 0; i < len(dbs); i++ {
-			if create_dbs {
-				createDatabase(dbs[i], httpClient, cloudantAccounts)
-			}
-			shareDatabases(dbs[i], httpClient, cloudantAccounts)
-			createReplicationDocuments(dbs[i], httpClient, cloudantAccounts)
+		bcr_utils.CheckErrorNonFatal(err)
+		password = getPassword(flags.ConfirmPassword)
+	}
+}
+
+/*
+*	Returns the endpoints whose login server turned down the password,
+*	in the order they were given. They are all asked at once.
+ */
+func rejectingEndpoints(loginClient bcr_utils.Doer, endpoints []string, username string, password string) []string {
+	responses := make(chan bool, len(endpoints))
+	results := make([]bool, len(endpoints))
+	for i := 0; i < len(endpoints); i++ {
+		go func(i int) {
+			results[i] = ca.RejectsPassword(loginClient, strings.TrimSuffix(endpoints[i], "/"), username, password)
+			responses <- true
+		}(i)
+	}
+	for i := 0; i < len(endpoints); i++ {
+		<-responses
+	}
+	var rejected []string
+	for i := 0; i < len(endpoints); i++ {
+		if results[i] {
+			rejected = append(rejected, endpoints[i])
+		}
+	}
+	return rejected
+}
+
+/*
+*	Returns the Bluemix API endpoints to look for the app in: the
+*	built-in ENDPOINTS, the endpoint cf is currently targeting and
+*	those passed with --api-endpoint, or only the latter with
+*	--only-endpoints. The current target covers regions missing from
+*	ENDPOINTS without having to pass them.
+ */
+func apiEndpoints(cliConnection plugin.CliConnection, flags bcr_utils.Flags) []string {
+	if flags.OnlyEndpoints {
+		return flags.ApiEndpoints
+	}
+	endpoints := append([]string{}, ENDPOINTS...)
+	if current, err := cliConnection.ApiEndpoint(); err == nil && current != "" {
+		flags.ApiEndpoints = append([]string{strings.TrimRight(current, "/")}, flags.ApiEndpoints...)
+	}
+	for i := 0; i < len(flags.ApiEndpoints); i++ {
+		if !bcr_utils.IsValid(flags.ApiEndpoints[i], endpoints) {
+			endpoints = append(endpoints, flags.ApiEndpoints[i])
 		}
-		deleteCookies(httpClient, cloudantAccounts)
-		finalSummary(appname, cloudantAccounts)
 	}
+	return endpoints
 }
 
-func finalSummary(appname string, cloudantAccounts []cam.CloudantAccount) {
-	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
-	fmt.Println("\nA Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+/*
+*	The one-line summary printed in place of finalSummary with --quiet
+ */
+func quietSummary(dbs []string, cloudantAccounts []cam.CloudantAccount, results bcr_replication.Report) {
+	outcome := terminal.ColorizeBold("OK", 32)
+	if !results.Success {
+		outcome = terminal.ColorizeBold("FAILED", 31)
+	}
+	fmt.Println(outcome + " replicating " + strconv.Itoa(len(dbs)) + " database(s) across " +
+		strconv.Itoa(len(cloudantAccounts)) + " accounts")
+}
+
+func finalSummary(appname string, endpoints []string, cloudantAccounts []cam.CloudantAccount) {
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Fprintln(bcr_utils.Out, "\nA Cloudant service was found for '"+terminal.ColorizeBold(appname, 36)+
 		"' and replication was attempted in the following regions:\n")
 	for i := 0; i < len(cloudantAccounts); i++ {
-		fmt.Println(terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36))
+		fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36))
 	}
-	if len(cloudantAccounts) != len(ENDPOINTS) {
-		fmt.Println("\nFailed regions:\n")
-		for i := 0; i < len(ENDPOINTS); i++ {
+	if len(cloudantAccounts) != len(endpoints) {
+		fmt.Fprint(bcr_utils.Out, "\nFailed regions:\n\n")
+		for i := 0; i < len(endpoints); i++ {
 			succeeded := false
 			for j := 0; j < len(cloudantAccounts); j++ {
-				if ENDPOINTS[i] == cloudantAccounts[j].Endpoint {
+				if endpoints[i] == cloudantAccounts[j].Endpoint {
 					succeeded = true
 				}
 			}
 			if !succeeded {
-				fmt.Println(terminal.ColorizeBold(ENDPOINTS[i], 36))
+				fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold(endpoints[i], 36))
 			}
 		}
 	}
 }
 
-func finalLogin(cliConnection plugin.CliConnection, endpoint string, username string, password string, org string, space string) {
-	fmt.Println("\nReturning you to your starting target\n")
-	cliConnection.CliCommandWithoutTerminalOutput("login", "-u", username, "-p", password, "-o", org, "-a", endpoint, "-s", space)
+type jsonSummary struct {
+	App                 string                             `json:"app"`
+	ReplicatorDatabases []bcr_replication.ReplicatorResult `json:"replicator_databases"`
+	Regions             []string                           `json:"regions"`
+	FailedRegions       []string                           `json:"failed_regions"`
+	Databases           []bcr_replication.DatabaseResult   `json:"databases"`
+	Sessions            []bcr_replication.RequestResult    `json:"sessions"`
+	Success             bool                               `json:"success"`
 }
 
 /*
-*	Sends all necessary requests to link all databases. These
-*	requests should generate documents in the target's
-*	_replicator database.
+*	The --json counterpart of finalSummary, printed regardless of
+*	bcr_utils.Out so that scripts can consume it.
  */
-func createReplicationDocuments(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
-	fmt.Println("\nCreating replication documents for '" + terminal.ColorizeBold(db, 36) + "'\n")
-	responses := make(chan bcr_utils.HttpResponse)
-	for i := 0; i < len(cloudantAccounts); i++ {
-		account := cloudantAccounts[i]
-		url := "https://" + account.Username + ".cloudant.com/_replicator"
-		for j := 0; j < len(cloudantAccounts); j++ {
-			if i != j {
-				go func(httpClient *http.Client, target cam.CloudantAccount, source cam.CloudantAccount, db string) {
-					source_dbs := bcr_utils.GetDatabases(httpClient, source)
-					target_dbs := bcr_utils.GetDatabases(httpClient, target)
-					if bcr_utils.IsValid(db, source_dbs) && bcr_utils.IsValid(db, target_dbs) {
-						rep := make(map[string]interface{})
-						rep["_id"] = source.Username + "-" + db
-						rep["source"] = source.Url + "/" + db
-						rep["target"] = target.Url + "/" + db
-						rep["create_target"] = false
-						rep["continuous"] = true
-						bd, _ := json.MarshalIndent(rep, " ", "  ")
-						body := string(bd)
-						headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
-						resp, err := bcr_utils.MakeRequest(httpClient, "POST", url, body, headers)
-						defer resp.Body.Close()
-						respBody, _ := ioutil.ReadAll(resp.Body)
-						split_status := strings.Split(resp.Status, " ")[0]
-						status, err := strconv.Atoi(split_status)
-						bcr_utils.CheckErrorFatal(err)
-						if status != 409 && status != 201 && status != 202 {
-							responses <- bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody),
-								Err: errors.New("Trouble creating " + rep["_id"].(string) + " for '" + account.Endpoint + "'")}
-						} else {
-							responses <- bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody), Err: err}
-						}
-					} else {
-						responses <- bcr_utils.HttpResponse{}
-					}
-				}(httpClient, account, cloudantAccounts[j], db)
-			}
-		}
-	}
-	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*(len(cloudantAccounts)-1))
-	close(responses)
+func printJsonSummary(appname string, endpoints []string, cloudantAccounts []cam.CloudantAccount, results bcr_replication.Report) {
+	bd, _ := json.MarshalIndent(newJsonSummary(appname, endpoints, cloudantAccounts, results), "", "  ")
+	fmt.Println(string(bd))
+}
+
+/*
+*	One entry of the --report file: the --json summary of a run and
+*	when it happened. Like the summary it never holds credentials.
+ */
+type runReport struct {
+	Time     string   `json:"time"`
+	Accounts []string `json:"accounts"`
+	jsonSummary
 }
 
-func createDatabase(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
-	fmt.Println("\nVerifying existence of '" + terminal.ColorizeBold(db, 36) + "' database for all regions")
-	responses := make(chan bcr_utils.HttpResponse)
+/*
+*	Appends the results of a run to the --report file as a single
+*	line of JSON, so that the file is a log of every run.
+ */
+func writeReport(path string, appname string, endpoints []string, cloudantAccounts []cam.CloudantAccount, results bcr_replication.Report) {
+	report := runReport{Time: time.Now().UTC().Format(time.RFC3339), Accounts: []string{},
+		jsonSummary: newJsonSummary(appname, endpoints, cloudantAccounts, results)}
 	for i := 0; i < len(cloudantAccounts); i++ {
-		go func(db string, httpClient *http.Client, account cam.CloudantAccount) {
-			url := "https://" + account.Username + ".cloudant.com/" + db
-			headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
-			resp, err := bcr_utils.MakeRequest(httpClient, "PUT", url, "", headers)
-			defer resp.Body.Close()
-			respBody, _ := ioutil.ReadAll(resp.Body)
-			split_status := strings.Split(resp.Status, " ")[0]
-			status, err := strconv.Atoi(split_status)
-			bcr_utils.CheckErrorFatal(err)
-			if status == 201 || status == 202 { // && status != 412 {
-				fmt.Println("Created '" + terminal.ColorizeBold(db, 36) + "' in '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
-				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
-			} else if status == 412 {
-				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
-			} else {
-				err := errors.New("Problem creating '" + terminal.ColorizeBold(db, 36) + "' in '" +
-					terminal.ColorizeBold(account.Endpoint, 36) + "'")
-				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
-			}
-		}(db, httpClient, cloudantAccounts[i])
+		report.Accounts = append(report.Accounts, cloudantAccounts[i].Username+"@"+cloudantAccounts[i].Endpoint)
+	}
+	bd, _ := json.Marshal(report)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if bcr_utils.CheckErrorNonFatal(err) {
+		return
 	}
-	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts))
-	close(responses)
+	defer f.Close()
+	_, err = f.Write(append(bd, '\n'))
+	bcr_utils.CheckErrorNonFatal(err)
 }
 
-func getPermissions(db string, httpClient *http.Client, account cam.CloudantAccount) bcr_utils.HttpResponse {
-	url := "https://" + account.Username + ".cloudant.com/_api/v2/db/" + db + "/_security"
-	headers := map[string]string{"Cookie": account.Cookie}
-	resp, err := bcr_utils.MakeRequest(httpClient, "GET", url, "", headers)
-	defer resp.Body.Close()
-	respBody, _ := ioutil.ReadAll(resp.Body)
-	return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody), Err: err}
+func newJsonSummary(appname string, endpoints []string, cloudantAccounts []cam.CloudantAccount, results bcr_replication.Report) jsonSummary {
+	summary := jsonSummary{App: appname, ReplicatorDatabases: results.Replicators, Regions: []string{}, FailedRegions: []string{},
+		Databases: results.Databases, Sessions: results.Sessions, Success: results.Success}
+	if summary.ReplicatorDatabases == nil {
+		summary.ReplicatorDatabases = []bcr_replication.ReplicatorResult{}
+	}
+	if summary.Databases == nil {
+		summary.Databases = []bcr_replication.DatabaseResult{}
+	}
+	if summary.Sessions == nil {
+		summary.Sessions = []bcr_replication.RequestResult{}
+	}
+	for i := 0; i < len(endpoints); i++ {
+		succeeded := false
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if endpoints[i] == cloudantAccounts[j].Endpoint {
+				succeeded = true
+			}
+		}
+		if succeeded {
+			summary.Regions = append(summary.Regions, endpoints[i])
+		} else {
+			summary.FailedRegions = append(summary.FailedRegions, endpoints[i])
+		}
+	}
+	return summary
 }
 
-func modifyPermissions(perms string, db string, httpClient *http.Client, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) bcr_utils.HttpResponse {
-	var parsed map[string]interface{}
-	json.Unmarshal([]byte(perms), &parsed)
+/*
+*	Logs out of the Cloudant sessions of cloudantAccounts, unless
+*	--keep-session is passed. Then the sessions are left to expire
+*	on their own and only the accounts they belong to are printed,
+*	never the cookies.
+ */
+func endSessions(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	if !flags.KeepSession {
+		return bcr_replication.DeleteCookies(httpClient, cloudantAccounts, syncOptions(flags))
+	}
 	for i := 0; i < len(cloudantAccounts); i++ {
-		if account.Username != cloudantAccounts[i].Username {
-			temp_parsed := make(map[string]interface{})
-			if parsed["cloudant"] != nil {
-				temp_parsed = parsed["cloudant"].(map[string]interface{})
-			}
-			if temp_parsed[cloudantAccounts[i].Username] == nil {
-				temp_parsed[cloudantAccounts[i].Username] = []string{"_reader", "_replicator"}
-			} else {
-				currPerms := temp_parsed[cloudantAccounts[i].Username].([]interface{})
-				addRead := true
-				addRep := true
-				for j := 0; j < len(currPerms); j++ {
-					if currPerms[j].(string) == "_reader" {
-						addRead = false
-					}
-					if currPerms[j].(string) == "_replicator" {
-						addRep = false
-					}
-				}
-				if addRead {
-					currPerms = append(currPerms, "_reader")
-				}
-				if addRep {
-					currPerms = append(currPerms, "_replicator")
-				}
-				temp_parsed[cloudantAccounts[i].Username] = currPerms
-			}
-			parsed["cloudant"] = map[string]interface{}(temp_parsed)
+		// IAM tokens are not sessions
+		if cloudantAccounts[i].Cookie != "" {
+			fmt.Fprintln(bcr_utils.Out, "\nKeeping the Cloudant session of '"+terminal.ColorizeBold(cloudantAccounts[i].Username, 36)+"' in '"+
+				terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36)+"'. It stays valid until Cloudant expires it.")
 		}
 	}
-	url := "https://" + account.Username + ".cloudant.com/_api/v2/db/" + db + "/_security"
-	bd, _ := json.MarshalIndent(parsed, " ", "  ")
-	body := string(bd)
-	headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
-	resp, err := bcr_utils.MakeRequest(httpClient, "PUT", url, body, headers)
-	defer resp.Body.Close()
-	respBody, _ := ioutil.ReadAll(resp.Body)
-	return bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
+	return nil
+}
+
+func finalLogin(cliConnection plugin.CliConnection, endpoint string, username string, password string, org string, space string) {
+	fmt.Fprint(bcr_utils.Out, "\nReturning you to your starting target\n\n")
+	cliConnection.CliCommandWithoutTerminalOutput("login", "-u", username, "-p", password, "-o", org, "-a", endpoint, "-s", space)
 }
 
 /*
-*	Retrieves the current permissions for each database that is to be
-*	replicated and modifies those permissions to allow read and replicate
-*	permissions for every other database
+*	Makes sure the regions passed with --hub and --source-region
+*	are among the accounts
  */
-func shareDatabases(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
-	fmt.Println("\nModifying database permissions for '" + terminal.ColorizeBold(db, 36) + "'\n")
-	responses := make(chan bcr_utils.HttpResponse)
-	for i := 0; i < len(cloudantAccounts); i++ {
-		go func(db string, httpClient *http.Client, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) {
-			r := getPermissions(db, httpClient, account)
-			split_status := strings.Split(r.Status, " ")[0]
-			status, _ := strconv.Atoi(split_status)
-			if status <= 200 && r.Err == nil {
-				responses <- r
-				responses <- modifyPermissions(r.Body, db, httpClient, account, cloudantAccounts)
-			} else {
-				r.Err = errors.New("Permissions GET request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) +
-					"'\nUse the '" + terminal.ColorizeBold("--create", 33) + "' argument to create non-existing databases")
-				responses <- r
-				responses <- bcr_utils.HttpResponse{}
-			}
-		}(db, httpClient, cloudantAccounts[i], cloudantAccounts)
+func checkRegions(cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) {
+	regions := map[string]string{"--hub": flags.Hub, "--source-region": flags.SourceRegion}
+	for flag, region := range regions {
+		found := region == ""
+		for i := 0; i < len(cloudantAccounts); i++ {
+			found = found || bcr_replication.InRegion(cloudantAccounts[i], region)
+		}
+		if !found {
+			bcr_utils.CheckErrorFatal(errors.New("No Cloudant account was found in the " + flag + " region '" + region + "'"))
+		}
 	}
-	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*2)
-	close(responses)
 }
 
 /*
-*	Deletes the cookies that were used to authenticate the api calls
+*	Makes sure --grant-as names exactly one principal for every account
  */
-func deleteCookies(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
-	fmt.Println("\nDeleting Cookies\n")
-	responses := make(chan bcr_utils.HttpResponse)
+func checkGrantAs(cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) {
+	if len(flags.GrantAs) == 0 {
+		return
+	}
+	if len(flags.GrantAs) != len(cloudantAccounts) {
+		bcr_utils.CheckErrorFatal(errors.New("--grant-as names " + strconv.Itoa(len(flags.GrantAs)) + " principals, but " +
+			strconv.Itoa(len(cloudantAccounts)) + " accounts were found"))
+	}
 	for i := 0; i < len(cloudantAccounts); i++ {
-		go func(httpClient *http.Client, account cam.CloudantAccount) {
-			url := "https://" + account.Username + ".cloudant.com/_session"
-			headers := map[string]string{"Cookie": account.Cookie}
-			r, err := bcr_utils.MakeRequest(httpClient, "DELETE", url, "", headers)
-			defer r.Body.Close()
-			split_status := strings.Split(r.Status, " ")[0]
-			status, err := strconv.Atoi(split_status)
-			bcr_utils.CheckErrorFatal(err)
-			if status != 200 || err != nil {
-				err = errors.New("Failed to delete cookie for '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
-			}
-			respBody, _ := ioutil.ReadAll(r.Body)
-			responses <- bcr_utils.HttpResponse{RequestType: "POST", Status: r.Status, Body: string(respBody), Err: err}
-		}(httpClient, cloudantAccounts[i])
+		_, ok := flags.GrantAs[cloudantAccounts[i].Endpoint]
+		if _, byRegion := flags.GrantAs[bcr_utils.GetRegion(cloudantAccounts[i].Endpoint)]; !ok && !byRegion {
+			bcr_utils.CheckErrorFatal(errors.New("--grant-as does not name a principal for '" + cloudantAccounts[i].Endpoint + "'"))
+		}
 	}
-	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts))
-	close(responses)
 }
 
 /*
@@ -350,13 +886,202 @@ func (c *BCReplicatorPlugin) GetMetadata() plugin.PluginMetadata {
 				// UsageDetails is optional
 				// It is used to show help of usage of each command
 				UsageDetails: plugin.Usage{
-					Usage: "cf cloudant-replicate [-a APP] [-d DATABASE] [-p PASSWORD] [--all-dbs] [--create]\n",
+					Usage: "cf cloudant-replicate [-a APP | --apps APPS | --app-guid GUID] [-d DATABASE] [-p PASSWORD] [-r REGIONS] [--all-dbs | --match PATTERN] [--list-from REGION] [--create] [--dry-run] [--once] [--timeout SECONDS] [--max-retries N] [--json] [--password-stdin] [--confirm-password] [--exclude DATABASES] [--include-system] [-v] [--concurrency N] [--parallel-dbs] [--parallel-accounts N] [--apikey KEY]\n" +
+						"    [--rps N] [--deadline DURATION] [--topology mesh|hub [--hub REGION] | --source-region REGION] [--report FILE] [--no-color] [--verify] [--wait [--max-wait SECONDS] [--interval SECONDS]] [--id-prefix PREFIX] [--proxy URL] [--insecure] [--only-permissions | --skip-permissions] [--api-endpoint URL]... [--only-endpoints] [--db-file FILE] [--yes] [--quiet] [--db-map REGION:DATABASE,...] [--grant-as REGION:PRINCIPAL,...] [--grant-roles ROLES] [--owner NAME] [--replicator-db NAME] [--resume] [--new-only] [--estimate] [--events] [--keep-session] [--cleanup-on-failure] [--allow-partial] [--login-timeout SECONDS] [--cache DURATION] [--worker-processes N] [--connection-timeout MILLISECONDS] [--replicator-option KEY=VALUE]... [--no-checkpoints] [--since-seq SEQ] [--filter DDOC/FILTER [--query-params JSON] | --no-ddocs] [--push-filter DDOC/FILTER] [--pull-filter DDOC/FILTER] [--push-once] [--pull-once]\n    cf cloudant-replicate --version\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-replicate                                   (prompts for the app, databases and password)\n" +
+						"   cf cloudant-replicate -a my-app -d usersdb,ordersdb -p PASSWORD\n" +
+						"   cf cloudant-replicate --apps my-app-ng,my-app-eu -d usersdb -p PASSWORD\n" +
+						"   cf cloudant-replicate -a my-app --all-dbs --create -r ng,eu-gb --password-stdin --yes < password.txt\n",
+					Options: map[string]string{
+						"a":                   "App",
+						"-apps":               "Comma-separated apps to gather the Cloudant services of, for apps named differently in each region",
+						"-app-guid":           "GUID of the app at the current target, in place of -a",
+						"d":                   "Database",
+						"-apikey":             "IAM API key to authenticate with Cloudant instead of the service's password",
+						"-all-dbs":            "Select all databases without prompting (also --all or --databases-all)",
+						"-match":              "Also select the databases whose names match this glob pattern, e.g. 'app_*'",
+						"-list-from":          "Only list the databases of this region for --all-dbs, --match and the prompt, instead of every region's",
+						"-concurrency":        "Maximum number of replication documents created at once (default 8)",
+						"-parallel-accounts":  "Maximum number of accounts databases are created in, or logged out of, at once (default all)",
+						"-parallel-dbs":       "Work on up to --concurrency databases at once, printing a line per finished database",
+						"-connection-timeout": "Milliseconds the replicator waits for Cloudant to respond (Cloudant's default if omitted)",
+						"-worker-processes":   "Number of processes each replication uses (Cloudant's default if omitted)",
+						"-replicator-option":  "Set any other field of the replication documents, e.g. checkpoint_interval=30000 (repeatable)",
+						"-no-checkpoints":     "Don't record checkpoints, so an interrupted replication starts over",
+						"-since-seq":          "Sequence of the source database to start replicating from, for use with --once",
+						"-filter":             "Only replicate documents passing this design document filter",
+						"-query-params":       "JSON object of parameters passed to the filter",
+						"-push-filter":        "With --topology hub, the filter of the replications from the hub to the other regions, instead of --filter",
+						"-pull-filter":        "With --topology hub, the filter of the replications from the other regions to the hub, instead of --filter",
+						"-push-once":          "With --topology hub, replicate from the hub to the other regions once instead of continuously",
+						"-pull-once":          "With --topology hub, replicate from the other regions to the hub once instead of continuously",
+						"-no-ddocs":           "Don't replicate design documents, so each region keeps its own indexes",
+						"-cleanup-on-failure": "If anything fails, delete the replication documents this run created",
+						"-keep-session":       "Don't log out of the Cloudant sessions at the end, leaving them valid until they expire",
+						"-version":            "Print the versions of the plugin and the cf CLI, then exit",
+						"-allow-partial":      "Continue with the accounts that could be logged in to when others can't",
+						"-login-timeout":      "Seconds to wait for each Cloudant account to log in (default 30)",
+						"-resume":             "Only do what an interrupted run left undone, skipping databases whose permissions and replications are in place",
+						"-new-only":           "Only sync the selected databases that have no replication documents yet",
+						"-estimate":           "Print the number of documents and the size of every database in each account before replicating",
+						"-events":             "Print newline-delimited JSON events to stdout as the run progresses, instead of the usual output",
+						"-owner":              "Recorded as x_created_by in the replication documents (the Bluemix username by default)",
+						"-create":             "Create non-existing databases",
+						"-dry-run":            "Print the requests that would be sent without changing anything",
+						"-once":               "Replicate once instead of continuously",
+						"-exclude":            "Comma-separated databases to leave out",
+						"-include-system":     "Also sync system databases such as _users",
+						"-json":               "Print a JSON summary of the results instead of progress messages",
+						"-timeout":            "Seconds to wait for each request to Cloudant (default 60)",
+						"-max-retries":        "Times to retry a request Cloudant rejects with 429 or 5xx (default 3)",
+						"p":                   "Password",
+						"-password-stdin":     "Read the password from stdin",
+						"-confirm-password":   "Ask for the password twice when prompting for it",
+						"r":                   "Comma-separated regions to sync (ng, au-syd, eu-gb)",
+						"-cache":              "Reuse the accounts found by a run less than DURATION (e.g. 1h) ago",
+						"-rps":                "Maximum number of requests sent to Cloudant per second (unlimited by default)",
+						"-deadline":           "Stop after DURATION (e.g. 10m) overall, cancelling the remaining work, unlike --timeout which applies to each request",
+						"-topology":           "mesh (default) replicates every region with every other, N*(N-1) replications; hub only replicates the other regions to and from --hub, 2*(N-1) replications, but changes reach the other regions through the hub and stop flowing while it is down",
+						"-hub":                "The region at the center of --topology hub",
+						"-source-region":      "Only replicate from this region to the others, e.g. to seed new regions",
+						"-report":             "Append a JSON record of the run to FILE",
+						"-no-color":           "Print without colors, as is done when the output is not a terminal",
+						"-verify":             "Check that a test document replicates to every region, and how long it takes",
+						"-wait":               "Wait for every replication to be triggered or completed before exiting",
+						"-max-wait":           "Seconds to --wait for the replications (default 600)",
+						"-interval":           "Seconds between checks of the replication states with --wait (default 5)",
+						"-id-prefix":          "Prefix for the _id of the replication documents",
+						"-replicator-db":      "Database to keep the replication documents in, ending in /_replicator (default _replicator)",
+						"-proxy":              "Proxy to send the requests to Cloudant through, overriding HTTPS_PROXY",
+						"-insecure":           "Don't verify the certificates of Cloudant servers, for Cloudant Local with self-signed certificates",
+						"-only-permissions":   "Only grant the database permissions, without creating replications",
+						"-skip-permissions":   "Create the replications without granting database permissions",
+						"-api-endpoint":       "Additional Bluemix API endpoint to look for the app in; can be repeated",
+						"-only-endpoints":     "Only use the endpoints passed with --api-endpoint",
+						"-db-file":            "File listing databases to sync, one per line",
+						"-db-map":             "Comma-separated REGION:DATABASE pairs naming the database in regions where its name differs",
+						"-grant-as":           "Comma-separated REGION:PRINCIPAL pairs, one per region, naming who each region is granted access as instead of its username",
+						"-grant-roles":        "Comma-separated roles to grant the other regions (default _reader,_replicator)",
+						"-quiet":              "Only print warnings, errors and a one-line summary",
+						"-yes":                "Grant the database permissions without asking for confirmation",
+						"v":                   "Log every request sent to Cloudant (credentials are hidden)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-unreplicate",
+				HelpText: "removes replication set up by cloudant-replicate across Cloudant databases in multiple Bluemix regions",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-unreplicate [-a APP | --apps APPS | --app-guid GUID] [-d DATABASE] [-p PASSWORD] [-r REGIONS] [--all-dbs] [--revoke [--grant-as REGION:PRINCIPAL,...] [--grant-roles ROLES]] [--id-prefix PREFIX] [--replicator-db NAME] [--confirm-password]\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-unreplicate                                 (prompts for the app, databases and password)\n" +
+						"   cf cloudant-unreplicate -a my-app -d usersdb -p PASSWORD --revoke\n",
+					Options: map[string]string{
+						"a":                 "App",
+						"-apps":             "The --apps the replication was set up with",
+						"-app-guid":         "GUID of the app at the current target, in place of -a",
+						"d":                 "Database",
+						"-all-dbs":          "Select all databases",
+						"-id-prefix":        "The --id-prefix the replication was set up with",
+						"-replicator-db":    "The --replicator-db the replication was set up with",
+						"-revoke":           "Also revoke the permissions granted to the other regions",
+						"-grant-as":         "The --grant-as the replication was set up with",
+						"-grant-roles":      "The --grant-roles the replication was set up with",
+						"-confirm-password": "Ask for the password twice when prompting for it",
+						"p":                 "Password",
+						"r":                 "Comma-separated regions to unsync (ng, au-syd, eu-gb)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-replication-check",
+				HelpText: "checks, without changing anything, that every Cloudant account bound to the app can be used by cloudant-replicate",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-replication-check [-a APP | --apps APPS | --app-guid GUID] [-d DATABASE] [-p PASSWORD] [-r REGIONS] [--all-dbs] [--create] [--replicator-db NAME]\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-replication-check -a my-app -d usersdb,ordersdb --password-stdin < password.txt\n",
+					Options: map[string]string{
+						"a":              "App",
+						"-apps":          "Comma-separated apps to gather the Cloudant services of",
+						"-app-guid":      "GUID of the app at the current target, in place of -a",
+						"d":              "Databases whose permissions must be readable",
+						"-all-dbs":       "Check the permissions of all databases",
+						"-create":        "Databases that don't exist yet will be created, so don't count them as failures",
+						"-replicator-db": "The replicator database that has to be readable (default _replicator)",
+						"p":              "Password",
+						"r":              "Comma-separated regions to check (ng, au-syd, eu-gb)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-replication-monitor",
+				HelpText: "waits for the replication set up by cloudant-replicate to become healthy, printing each change in its state",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-replication-monitor [-a APP | --apps APPS | --app-guid GUID] [-d DATABASE] [-p PASSWORD] [-r REGIONS] [--all-dbs] [--interval SECONDS] [--max-wait SECONDS] [--id-prefix PREFIX] [--replicator-db NAME] [--topology mesh|hub [--hub REGION]]\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-replication-monitor -a my-app --all-dbs -p PASSWORD --max-wait 300\n",
+					Options: map[string]string{
+						"a":              "App",
+						"-apps":          "The --apps the replication was set up with",
+						"-app-guid":      "GUID of the app at the current target, in place of -a",
+						"d":              "Database",
+						"-all-dbs":       "Select all databases",
+						"-interval":      "Seconds between checks of the replication states (default 5)",
+						"-max-wait":      "Seconds to wait for every replication to be triggered or completed (default 600)",
+						"-id-prefix":     "The --id-prefix the replication was set up with",
+						"-replicator-db": "The --replicator-db the replication was set up with",
+						"-topology":      "The --topology the replication was set up with",
+						"-hub":           "The --hub the replication was set up with",
+						"p":              "Password",
+						"r":              "Comma-separated regions to monitor (ng, au-syd, eu-gb)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-replicate-accounts",
+				HelpText: "configures replication between the Cloudant accounts listed in a config file",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-replicate-accounts --config FILE [-d DATABASE] [--all-dbs | --match PATTERN] [--create] [--dry-run] [--once] [--json] [--yes] [--apikey KEY] [--db-map NAME:DATABASE,...] [--new-only] [--estimate] [--events] [--wait [--max-wait SECONDS] [--interval SECONDS]]\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-replicate-accounts --config accounts.json   (prompts for the databases)\n" +
+						"   cf cloudant-replicate-accounts --config accounts.json -d usersdb --yes\n",
+					Options: map[string]string{
+						"d":         "Database",
+						"-all-dbs":  "Select all databases",
+						"-match":    "Also select the databases whose names match this glob pattern, e.g. 'app_*'",
+						"-apikey":   "IAM API key for accounts that do not have their own",
+						"-config":   "JSON file listing the accounts to replicate between",
+						"-create":   "Create non-existing databases",
+						"-db-map":   "Comma-separated NAME:DATABASE pairs naming the database in accounts where its name differs",
+						"-dry-run":  "Print the requests that would be sent without changing anything",
+						"-new-only": "Only sync the selected databases that have no replication documents yet",
+						"-estimate": "Print the number of documents and the size of every database in each account before replicating",
+						"-events":   "Print newline-delimited JSON events to stdout as the run progresses, instead of the usual output",
+						"-json":     "Print a JSON summary of the results instead of progress messages",
+						"-once":     "Replicate once instead of continuously",
+						"-wait":     "Wait for every replication to be triggered or completed before exiting",
+						"-max-wait": "Seconds to --wait for the replications (default 600)",
+						"-interval": "Seconds between checks of the replication states with --wait (default 5)",
+						"-yes":      "Grant the database permissions without asking for confirmation"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-replication-status",
+				HelpText: "reports the state of the replication set up by cloudant-replicate",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-replication-status [-a APP | --apps APPS | --app-guid GUID] [-d DATABASE] [-p PASSWORD] [-r REGIONS] [--all-dbs] [--id-prefix PREFIX] [--replicator-db NAME] [--topology mesh|hub [--hub REGION]]\n" +
+						"\nEXAMPLES:\n" +
+						"   cf cloudant-replication-status                          (prompts for the app, databases and password)\n" +
+						"   cf cloudant-replication-status -a my-app --all-dbs -p PASSWORD\n",
 					Options: map[string]string{
-						"a":        "App",
-						"d":        "Database",
-						"-all-dbs": "Select all databases",
-						"-create":  "Create non-existing databases",
-						"p":        "Password"},
+						"a":              "App",
+						"-apps":          "The --apps the replication was set up with",
+						"-app-guid":      "GUID of the app at the current target, in place of -a",
+						"d":              "Database",
+						"-all-dbs":       "Select all databases",
+						"-id-prefix":     "The --id-prefix the replication was set up with",
+						"-replicator-db": "The --replicator-db the replication was set up with",
+						"-topology":      "The --topology the replication was set up with",
+						"-hub":           "The --hub the replication was set up with",
+						"p":              "Password",
+						"r":              "Comma-separated regions to check (ng, au-syd, eu-gb)"},
 				},
 			},
 		},
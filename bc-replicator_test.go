@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/cloudfoundry/cli/plugin/models"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	bcr_utils.Out, bcr_utils.Errors = ioutil.Discard, ioutil.Discard
+	os.Exit(m.Run())
+}
+
+/*
+*	A cf CLI logged in to endpoint, where "cf env" lists the
+*	environment in envs of the endpoint last logged in to
+ */
+type fakeCli struct {
+	plugin.CliConnection
+	endpoint string
+	envs     map[string][]string
+	lock     sync.Mutex
+	commands [][]string
+}
+
+func (c *fakeCli) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.commands = append(c.commands, args)
+	switch args[0] {
+	case "login":
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "-a" {
+				c.endpoint = args[i+1]
+			}
+		}
+	case "env":
+		if env, ok := c.envs[c.endpoint]; ok {
+			return env, nil
+		}
+		return nil, errors.New("App " + args[1] + " not found")
+	}
+	return nil, nil
+}
+
+func (c *fakeCli) CliCommand(args ...string) ([]string, error) {
+	return c.CliCommandWithoutTerminalOutput(args...)
+}
+
+func (c *fakeCli) ApiEndpoint() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.endpoint, nil
+}
+
+func (c *fakeCli) IsLoggedIn() (bool, error) {
+	return true, nil
+}
+
+func (c *fakeCli) Username() (string, error) {
+	return "someone@example.com", nil
+}
+
+func (c *fakeCli) GetCurrentOrg() (plugin_models.Organization, error) {
+	return plugin_models.Organization{OrganizationFields: plugin_models.OrganizationFields{Name: "org"}}, nil
+}
+
+func (c *fakeCli) GetCurrentSpace() (plugin_models.Space, error) {
+	return plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Name: "dev"}}, nil
+}
+
+func (c *fakeCli) GetApps() ([]plugin_models.GetAppsModel, error) {
+	return []plugin_models.GetAppsModel{{Name: "myapp"}}, nil
+}
+
+/*
+*	Returns the arguments of every command run that starts with name
+ */
+func (c *fakeCli) ran(name string) [][]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var commands [][]string
+	for i := 0; i < len(c.commands); i++ {
+		if c.commands[i][0] == name {
+			commands = append(commands, c.commands[i])
+		}
+	}
+	return commands
+}
+
+/*
+*	Serves the cf API's /v2/info, without a login server, and a Cloudant
+*	account user-ng whose password is secret, recording the requests
+ */
+type fakeServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	s := &fakeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.lock.Unlock()
+		switch r.URL.Path {
+		case "/v2/info":
+			w.Write([]byte(`{}`))
+		case "/_session":
+			r.ParseForm()
+			if r.Method == "POST" && (r.PostForm.Get("name") != "user-ng" || r.PostForm.Get("password") != "secret") {
+				w.WriteHeader(401)
+				return
+			}
+			w.Header().Set("Set-Cookie", "AuthSession=user-ng")
+			w.Write([]byte(`{"ok":true}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+/*
+*	The output of "cf env" for an app bound to the Cloudant account at accountUrl
+ */
+func appEnv(accountUrl string) []string {
+	return []string{`{
+ "VCAP_SERVICES": {
+  "cloudantNoSQLDB": [
+   {
+    "credentials": {
+     "password": "secret",
+     "url": "` + accountUrl + `",
+     "username": "user-ng"
+    }
+   }
+  ]
+ }
+}`}
+}
+
+/*
+*	Runs the plugin with args against cli, returning the status it
+*	exited with
+ */
+func runPlugin(cli *fakeCli, args ...string) int {
+	status := 0
+	exit = func(code int) { status = code }
+	defer func() {
+		exit = os.Exit
+		bcr_utils.Ctx = context.Background()
+	}()
+	new(BCReplicatorPlugin).Run(cli, args)
+	return status
+}
+
+func TestRunWithPasswordFlag(t *testing.T) {
+	cli := &fakeCli{endpoint: "https://api.example.com"}
+	defer func(saved func(bool) string) { getPassword = saved }(getPassword)
+	getPassword = func(confirm bool) string {
+		t.Error("asked for the password although -p was passed")
+		return ""
+	}
+	runPlugin(cli, "cloudant-replicate", "-a", "myapp", "-p", "s3cret", "-d", "db1")
+	logins := cli.ran("login")
+	if len(logins) == 0 {
+		t.Fatal("never logged in to the other regions")
+	}
+	for i := 0; i < len(logins); i++ {
+		if !strings.Contains(strings.Join(logins[i], " "), "-p s3cret") {
+			t.Errorf("logged in with %v instead of the -p password", logins[i])
+		}
+	}
+}
+
+func TestRunPromptsWithoutPasswordFlag(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	cli := &fakeCli{endpoint: server.URL}
+	t.Setenv("CLOUDANT_SYNC_PASSWORD", "")
+	defer func(saved func(bool) string) { getPassword = saved }(getPassword)
+	prompts := 0
+	getPassword = func(confirm bool) string {
+		prompts += 1
+		return "typed"
+	}
+	runPlugin(cli, "cloudant-replicate", "-a", "myapp", "-d", "db1", "--only-endpoints", "--api-endpoint", server.URL)
+	if prompts != 1 {
+		t.Errorf("asked for the password %d times, want once", prompts)
+	}
+}
+
+func TestRunWithSingleAccount(t *testing.T) {
+	server := newFakeServer(t)
+	cli := &fakeCli{endpoint: "https://api.example.com", envs: map[string][]string{"https://api.ng.bluemix.net": appEnv(server.URL)}}
+	var errs bytes.Buffer
+	bcr_utils.Errors = &errs
+	defer func() { bcr_utils.Errors = ioutil.Discard }()
+	status := runPlugin(cli, "cloudant-replicate", "-a", "myapp", "-p", "s3cret", "-d", "db1", "-y")
+	if status != 1 {
+		t.Errorf("exited with status %d, want 1", status)
+	}
+	if !strings.Contains(errs.String(), "Multi-region sync requires the app to be deployed in at least two regions") {
+		t.Errorf("reported %q, want the single account explained", errs.String())
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.requests) == 0 || server.requests[0] != "POST /_session" {
+		t.Errorf("sent %q, want the account logged in to", server.requests)
+	}
+	for i := 0; i < len(server.requests); i++ {
+		if strings.Contains(server.requests[i], "_replicator") || strings.Contains(server.requests[i], "_security") {
+			t.Errorf("sent %s with a single account", server.requests[i])
+		}
+	}
+}
+
+func TestHttpClientHonoursInsecure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	for _, insecure := range []bool{false, true} {
+		flags := bcr_utils.DefaultFlags()
+		flags.Insecure = insecure
+		httpClient := newHttpClient(flags)
+		if skip := httpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify; skip != insecure {
+			t.Errorf("with --insecure %t the certificates are skipped: %t", insecure, skip)
+		}
+		resp, err := httpClient.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if insecure && err != nil {
+			t.Errorf("with --insecure the self-signed certificate was rejected: %v", err)
+		}
+		if !insecure && err == nil {
+			t.Error("without --insecure the self-signed certificate was accepted")
+		}
+	}
+}
+
+/*
+*	Serves the cf API's /v2/info and a login server that turns down
+*	rejected and accepts any other password, recording those it was sent
+ */
+func newLoginServer(t *testing.T, rejected string, sent *[]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/info":
+			w.Write([]byte(`{"authorization_endpoint": "` + server.URL + `"}`))
+		case "/oauth/token":
+			r.ParseForm()
+			*sent = append(*sent, r.PostForm.Get("password"))
+			if r.PostForm.Get("password") == rejected {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"access_token": "token"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckPasswordListsRejectingEndpoints(t *testing.T) {
+	var sentToAccepting, sentToRejecting []string
+	accepting := newLoginServer(t, "", &sentToAccepting)
+	rejecting := newLoginServer(t, "old", &sentToRejecting)
+	var errs bytes.Buffer
+	bcr_utils.Errors = &errs
+	defer func() { bcr_utils.Errors = ioutil.Discard }()
+	defer func(saved func(bool) string) { getPassword = saved }(getPassword)
+	getPassword = func(confirm bool) string {
+		return "new"
+	}
+	password := checkPassword(&fakeCli{endpoint: accepting.URL}, "old", []string{accepting.URL, rejecting.URL}, bcr_utils.DefaultFlags())
+	if password != "new" {
+		t.Errorf("returned %q, want the password typed again", password)
+	}
+	want := []string{"old", "new"}
+	if !reflect.DeepEqual(sentToAccepting, want) || !reflect.DeepEqual(sentToRejecting, want) {
+		t.Errorf("sent %q and %q, want %q to both endpoints", sentToAccepting, sentToRejecting, want)
+	}
+	rejection := terminal.Decolorize(errs.String())
+	if !strings.Contains(rejection, rejecting.URL) || strings.Contains(rejection, accepting.URL) {
+		t.Errorf("reported %q, want only %s listed as rejecting the password", rejection, rejecting.URL)
+	}
+}
+
+func TestLoginClientIgnoresInsecureAndProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	flags := bcr_utils.DefaultFlags()
+	flags.Insecure = true
+	flags.Proxy = &url.URL{Scheme: "http", Host: "proxy.example.com:8080"}
+	loginClient := newLoginClient(flags)
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if proxy, _ := loginClient.Transport.(*http.Transport).Proxy(req); proxy != nil && proxy.Host == flags.Proxy.Host {
+		t.Errorf("the password would be sent through the --proxy %s", proxy)
+	}
+	resp, err := loginClient.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Error("with --insecure the login server's self-signed certificate was accepted")
+	}
+}
+
+/*
+*	Answers every request with 200, recording them as "METHOD url cookie"
+ */
+type recordingDoer struct {
+	lock     sync.Mutex
+	requests []string
+}
+
+func (d *recordingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.lock.Lock()
+	d.requests = append(d.requests, req.Method+" "+req.URL.String()+" "+req.Header.Get("Cookie"))
+	d.lock.Unlock()
+	return &http.Response{Status: "200 OK", StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(`{"ok":true}`))}, nil
+}
+
+func TestDistinctAccountsAtTheSameUrl(t *testing.T) {
+	cloudantAccounts := []cam.CloudantAccount{
+		{Endpoint: "https://api.ng.bluemix.net", Username: "shared", Url: "https://shared:pw@shared.example.com", Cookie: "AuthSession=ng"},
+		{Endpoint: "https://api.eu-gb.bluemix.net", Username: "other", Url: "https://other:pw@other.example.com", Cookie: "AuthSession=eu-gb"},
+		{Endpoint: "https://api.au-syd.bluemix.net", Username: "shared", Url: "https://shared:pw@shared.example.com/", Cookie: "AuthSession=au-syd"},
+	}
+	var errs bytes.Buffer
+	bcr_utils.Errors = &errs
+	defer func() { bcr_utils.Errors = ioutil.Discard }()
+	httpClient := &recordingDoer{}
+	distinct := distinctAccounts(httpClient, cloudantAccounts, bcr_utils.DefaultFlags())
+	if len(distinct) != 2 || distinct[0].Endpoint != cloudantAccounts[0].Endpoint || distinct[1].Endpoint != cloudantAccounts[1].Endpoint {
+		t.Errorf("kept %+v, want the ng and eu-gb accounts", distinct)
+	}
+	if !strings.Contains(terminal.Decolorize(errs.String()), "'https://api.au-syd.bluemix.net' is the same Cloudant account as 'https://api.ng.bluemix.net'") {
+		t.Errorf("warned %q, want the au-syd account reported as a duplicate", errs.String())
+	}
+	if want := []string{"DELETE https://shared.example.com/_session AuthSession=au-syd"}; !reflect.DeepEqual(httpClient.requests, want) {
+		t.Errorf("sent %q, want only the duplicate's session ended", httpClient.requests)
+	}
+}
+
+/*
+*	Answers GETs with 200 and every other request with 403
+ */
+type forbiddingDoer struct{}
+
+func (forbiddingDoer) Do(req *http.Request) (*http.Response, error) {
+	status := 200
+	if req.Method != "GET" {
+		status = 403
+	}
+	return &http.Response{Status: http.StatusText(status), StatusCode: status, Header: http.Header{},
+		Body: ioutil.NopCloser(strings.NewReader(`{}`))}, nil
+}
+
+func TestRevokePermissionsReportsRejectedPut(t *testing.T) {
+	account := cam.CloudantAccount{Endpoint: "https://api.ng.bluemix.net", Username: "ng", Url: "https://ng.example.com"}
+	other := cam.CloudantAccount{Endpoint: "https://api.eu-gb.bluemix.net", Username: "eu-gb", Url: "https://eu-gb.example.com"}
+	perms := `{"cloudant":{"eu-gb":["_reader","_replicator"]}}`
+	r := revokePermissions(perms, "https://ng.example.com/_api/v2/db/db1/_security", "db1", forbiddingDoer{}, account,
+		[]cam.CloudantAccount{account, other}, bcr_utils.DefaultFlags())
+	syncErr, ok := r.Err.(*bcr_utils.SyncError)
+	if !ok || syncErr.Phase != bcr_utils.PhasePermissions || syncErr.Database != "db1" || syncErr.Account != account.Endpoint {
+		t.Errorf("got %+v, want a permissions SyncError for db1 in %s", r, account.Endpoint)
+	}
+}
+
+func TestSyncOptionsMapEveryField(t *testing.T) {
+	flags := bcr_utils.DefaultFlags()
+	flags.ReplicatorDb, flags.IdPrefix, flags.Owner, flags.Topology, flags.Hub = "ops/_replicator", "nightly", "ops", "hub", "ng"
+	flags.Create, flags.DryRun, flags.Verify, flags.CleanupOnFailure = true, true, true, true
+	flags.OnlyPermissions, flags.SkipPermissions = true, true
+	flags.MaxRetries, flags.Concurrency, flags.ParallelDbs, flags.ParallelAccounts = 5, 2, true, 3
+	flags.DbMap, flags.GrantAs = map[string]string{"eu-gb": "db_eu"}, map[string]string{"ng": "apikey-ng"}
+	flags.SourceRegion, flags.Once, flags.PushOnce, flags.PullOnce = "ng", true, true, true
+	flags.Filter, flags.PushFilter, flags.PullFilter = "app/active", "app/push", "app/pull"
+	flags.QueryParams = map[string]interface{}{"status": "active"}
+	flags.NoDdocs, flags.NoCheckpoints, flags.SinceSeq = true, true, "now"
+	flags.WorkerProcesses, flags.ConnectionTimeout = 4, 30000
+	flags.ReplicatorOptions = map[string]interface{}{"checkpoint_interval": "30000"}
+	opts := reflect.ValueOf(syncOptions(flags))
+	for i := 0; i < opts.NumField(); i++ {
+		name := opts.Type().Field(i).Name
+		flag := reflect.ValueOf(flags).FieldByName(name)
+		if !flag.IsValid() {
+			t.Errorf("Options.%s is not one of the flags", name)
+			continue
+		}
+		if reflect.ValueOf(flag.Interface()).IsZero() {
+			t.Errorf("the test leaves %s unset", name)
+		}
+		if !reflect.DeepEqual(opts.Field(i).Interface(), flag.Interface()) {
+			t.Errorf("%s is %v in the options, want %v", name, opts.Field(i).Interface(), flag.Interface())
+		}
+	}
+}
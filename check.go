@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"strconv"
+)
+
+type accountCheck struct {
+	endpoint string
+	problems []string
+}
+
+/*
+*	Checks, without changing anything, that every Cloudant account
+*	bound to the app can be logged in to and that its _replicator
+*	database and the _security documents of the selected databases
+*	can be read. Returns false if any account fails, so that it can
+*	gate cloudant-replicate in CI.
+ */
+func checkReplication(cliConnection plugin.CliConnection, args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password, endpoints := setup(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := getCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+	bcr_utils.CheckErrorFatal(err)
+	// no prompting, so that the check can run unattended
+	dbs := flags.Dbs
+	if flags.AllDbs {
+		dbs = bcr_utils.GetAllDatabases(httpClient, cloudantAccounts)
+	}
+	ch := make(chan accountCheck)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(httpClient bcr_utils.Doer, account cam.CloudantAccount) {
+			ch <- checkAccount(dbs, httpClient, account, flags)
+		}(httpClient, cloudantAccounts[i])
+	}
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nPREFLIGHT", 35)+"\n")
+	healthy := true
+	for i := 0; i < len(cloudantAccounts); i++ {
+		c := <-ch
+		if len(c.problems) == 0 {
+			fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("OK", 32)+"      '"+terminal.ColorizeBold(c.endpoint, 36)+"'")
+			continue
+		}
+		healthy = false
+		fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("FAILED", 31)+"  '"+terminal.ColorizeBold(c.endpoint, 36)+"'")
+		for j := 0; j < len(c.problems); j++ {
+			fmt.Fprintln(bcr_utils.Errors, "        "+c.problems[j])
+		}
+	}
+	close(ch)
+	for i := 0; i < len(endpoints); i++ {
+		found := false
+		for j := 0; j < len(cloudantAccounts); j++ {
+			found = found || cloudantAccounts[j].Endpoint == endpoints[i]
+		}
+		if !found && len(flags.Apps) == 0 {
+			fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("MISSING", 33)+" '"+terminal.ColorizeBold(endpoints[i], 36)+"' has no Cloudant service for '"+
+				terminal.ColorizeBold(appname, 36)+"'")
+		}
+	}
+	if len(cloudantAccounts) < 2 {
+		healthy = false
+		bcr_utils.CheckErrorNonFatal(errors.New("Replication requires at least two Cloudant accounts, but only " +
+			strconv.Itoa(len(cloudantAccounts)) + " were found"))
+	}
+	endSessions(httpClient, cloudantAccounts, flags)
+	return healthy
+}
+
+/*
+*	Reads the _replicator database of account and the _security
+*	document of each of dbs, returning what went wrong. A missing
+*	_replicator database is fine, cloudant-replicate creates it.
+ */
+func checkAccount(dbs []string, httpClient bcr_utils.Doer, account cam.CloudantAccount, flags bcr_utils.Flags) accountCheck {
+	check := accountCheck{endpoint: account.Endpoint}
+	if status, reason := checkRead(httpClient, account, bcr_utils.GetApiUrl(account)+"/"+bcr_utils.DatabasePath(flags.ReplicatorDb), flags); status != 200 && status != 404 {
+		check.problems = append(check.problems, "unable to read the "+flags.ReplicatorDb+" database: "+reason)
+	}
+	for i := 0; i < len(dbs); i++ {
+		db := bcr_replication.AccountDatabase(dbs[i], account, flags)
+		url := bcr_utils.GetApiUrl(account) + "/_api/v2/db/" + bcr_utils.DatabasePath(db) + "/_security"
+		status, reason := checkRead(httpClient, account, url, flags)
+		if status == 404 {
+			// plain CouchDB only has the standard endpoint
+			couchUrl := bcr_utils.GetApiUrl(account) + "/" + bcr_utils.DatabasePath(db) + "/_security"
+			if couchStatus, couchReason := checkRead(httpClient, account, couchUrl, flags); couchStatus == 200 {
+				status, reason = couchStatus, couchReason
+			}
+		}
+		if status == 404 && flags.Create {
+			continue
+		} else if status != 200 {
+			check.problems = append(check.problems, "unable to read the permissions of '"+db+"': "+reason)
+		}
+	}
+	return check
+}
+
+/*
+*	GETs url as account, returning the status code and, when it is
+*	not 200, why
+ */
+func checkRead(httpClient bcr_utils.Doer, account cam.CloudantAccount, url string, flags bcr_utils.Flags) (int, string) {
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", url, "", nil, account, flags.MaxRetries)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	reason := resp.Status
+	if body := bcr_utils.ErrorReason(string(respBody)); body != "" && resp.StatusCode != 200 {
+		reason += " (" + body + ")"
+	}
+	return resp.StatusCode, reason
+}
@@ -0,0 +1,146 @@
+package ca
+
+import (
+	"encoding/json"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/prompts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+*	What was discovered for one app, keyed by CacheKey: the endpoints that were searched
+*	and the accounts found in them. Passwords, cookies and tokens are
+*	never written to the cache.
+ */
+type cacheEntry struct {
+	Time      time.Time       `json:"time"`
+	Endpoints []string        `json:"endpoints"`
+	Accounts  []cachedAccount `json:"accounts"`
+}
+
+type cachedAccount struct {
+	Endpoint  string   `json:"endpoint"`
+	Username  string   `json:"username"`
+	Url       string   `json:"url"`
+	Databases []string `json:"databases,omitempty"`
+}
+
+/*
+*	Returns the location of the account cache,
+*	~/.cf/bluemix-cloudant-replicator/accounts.json
+ */
+func CachePath() string {
+	return filepath.Join(os.Getenv("HOME"), ".cf", "bluemix-cloudant-replicator", "accounts.json")
+}
+
+/*
+*	Deletes the account cache along with the directory holding it
+ */
+func RemoveCache() error {
+	return os.RemoveAll(filepath.Dir(CachePath()))
+}
+
+/*
+*	Returns the key the accounts of appname are cached under. The same
+*	app name may be used in other orgs, spaces or Bluemix instances, so
+*	the current target's API endpoint, org and space are part of it.
+ */
+func CacheKey(apiEndpoint string, org string, space string, appname string) string {
+	return strings.Join([]string{strings.TrimSuffix(apiEndpoint, "/"), org, space, appname}, "|")
+}
+
+func readCache() map[string]cacheEntry {
+	cache := make(map[string]cacheEntry)
+	contents, err := ioutil.ReadFile(CachePath())
+	if err == nil {
+		json.Unmarshal(contents, &cache)
+	}
+	return cache
+}
+
+/*
+*	Returns the accounts cached under key if they were discovered less
+*	than ttl ago in a search covering all of endpoints. They are
+*	authenticated afresh: with a single IAM token for apikey, or
+*	otherwise with a session cookie for the Cloudant password the user
+*	is asked for. The second return value is false on a cache miss, or
+*	if any of the accounts can't be logged in to.
+ */
+func GetCachedCloudantAccounts(httpClient bcr_utils.Doer, endpoints []string, key string, apikey string, ttl time.Duration) ([]cam.CloudantAccount, bool) {
+	var cloudantAccounts []cam.CloudantAccount
+	entry, ok := readCache()[key]
+	if !ok || time.Since(entry.Time) > ttl {
+		return cloudantAccounts, false
+	}
+	for i := 0; i < len(endpoints); i++ {
+		if !bcr_utils.IsValid(endpoints[i], entry.Endpoints) {
+			return cloudantAccounts, false
+		}
+	}
+	// the passwords can only be asked for
+	if apikey == "" && !bcr_utils.IsTerminal(os.Stdin) {
+		return cloudantAccounts, false
+	}
+	token := ""
+	if apikey != "" {
+		var err error
+		if token, err = getIamToken(apikey, httpClient); err != nil {
+			return cloudantAccounts, false
+		}
+	}
+	for i := 0; i < len(entry.Accounts); i++ {
+		cached := entry.Accounts[i]
+		if !bcr_utils.IsValid(cached.Endpoint, endpoints) {
+			continue
+		}
+		if _, err := bcr_utils.ParseApiUrl(cam.CloudantAccount{Url: cached.Url}); err != nil {
+			deleteCookies(httpClient, cloudantAccounts)
+			return nil, false
+		}
+		account := cam.CloudantAccount{Endpoint: cached.Endpoint, Username: cached.Username, Url: cached.Url, ApiKey: apikey,
+			Token: token, Databases: cached.Databases}
+		if apikey == "" {
+			account.Password = bcr_prompts.GetCloudantPassword("The Cloudant credentials cached for '"+terminal.ColorizeBold(cached.Endpoint, 36)+"' have no password.",
+				cached.Username)
+			cookie, err := getCookie(account, httpClient)
+			if err != nil {
+				deleteCookies(httpClient, cloudantAccounts)
+				return nil, false
+			}
+			account.Cookie = cookie
+		}
+		cloudantAccounts = append(cloudantAccounts, account)
+	}
+	return cloudantAccounts, true
+}
+
+/*
+*	Records the accounts discovered in endpoints under key, stripping
+*	the credentials from their urls.
+ */
+func CacheCloudantAccounts(key string, endpoints []string, cloudantAccounts []cam.CloudantAccount) error {
+	cache := readCache()
+	entry := cacheEntry{Time: time.Now(), Endpoints: endpoints, Accounts: []cachedAccount{}}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		accountUrl := cloudantAccounts[i].Url
+		if u, err := url.Parse(accountUrl); err == nil {
+			u.User = nil
+			accountUrl = u.String()
+		}
+		entry.Accounts = append(entry.Accounts, cachedAccount{Endpoint: cloudantAccounts[i].Endpoint,
+			Username: cloudantAccounts[i].Username, Url: accountUrl, Databases: cloudantAccounts[i].Databases})
+	}
+	cache[key] = entry
+	contents, _ := json.MarshalIndent(cache, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(CachePath()), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(CachePath(), contents, 0600)
+}
@@ -1,64 +1,170 @@
 package ca
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cloudfoundry/cli/cf/terminal"
 	"github.com/cloudfoundry/cli/plugin"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/prompts"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
-	"net/http"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var IAM_TOKEN_URL = "https://iam.cloud.ibm.com/identity/token"
+
+/*
+*	One account in the config file read by GetAccountsFromConfig.
+*	Credentials can be given in the url or as separate fields.
+ */
+type accountConfig struct {
+	Name     string `json:"name"`
+	Url      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ApiKey   string `json:"apikey"`
+}
+
 type CreateAccountResponse struct {
 	account cam.CloudantAccount
 	err     error
+	// the service was found, but logging in to it failed
+	loginFailed bool
+}
+
+/*
+*	The accounts GetCloudantAccounts found but could not log in to,
+*	one error each
+ */
+type LoginErrors []error
+
+func (e LoginErrors) Error() string {
+	var msgs []string
+	for i := 0; i < len(e); i++ {
+		msgs = append(msgs, e[i].Error())
+	}
+	return strings.Join(msgs, "\n")
 }
 
 func init() {
 	terminal.InitColorSupport()
+	bcr_utils.Reauthenticate = authenticate
 }
 
-func createAccount(cliConnection plugin.CliConnection, httpClient *http.Client, env []string, endpoint string) CreateAccountResponse {
+/*
+*	Gets fresh credentials for account: a new IAM token if it
+*	uses an API key, a new session cookie otherwise.
+ */
+func authenticate(httpClient bcr_utils.Doer, account cam.CloudantAccount) (cam.CloudantAccount, error) {
+	var err error
+	if account.ApiKey != "" {
+		account.Token, err = getIamToken(account.ApiKey, httpClient)
+		return account, err
+	}
+	account.Cookie, err = getCookie(account, httpClient)
+	return account, err
+}
+
+/*
+*	Builds the account of the service bound in env with the service's
+*	own credentials. cloudantPassword is only used when the binding
+*	has no password.
+ */
+func createAccount(cliConnection plugin.CliConnection, httpClient bcr_utils.Doer, env []string, endpoint string, apikey string, cloudantPassword string) CreateAccountResponse {
 	account, err := parseCreds(env)
+	if account.Password == "" {
+		account.Password = cloudantPassword
+	}
+	// IAM credentials come without a legacy password
+	if err == nil && account.Password == "" && apikey == "" {
+		err = errors.New("Cloudant credentials incomplete\n")
+	}
 	if err != nil {
 		err = errors.New("Problem finding Cloudant credentials for app at '" + terminal.ColorizeBold(endpoint, 36) +
 			"'.\nMake sure that there is a valid 'cloudantNoSQLDB' service bound to your app.\nContinuing on with other regions.\n")
 		return CreateAccountResponse{account: account, err: err}
 	}
 	account.Endpoint = endpoint
-	account.Cookie = getCookie(account, httpClient)
-	return CreateAccountResponse{account: account, err: nil}
+	account.Databases = parseDatabases(env)
+	if apikey != "" {
+		account.ApiKey = apikey
+		account.Token, err = getIamToken(apikey, httpClient)
+	} else {
+		account.Cookie, err = getCookie(account, httpClient)
+	}
+	if err != nil {
+		err = errors.New("Unable to log in to Cloudant for '" + terminal.ColorizeBold(endpoint, 36) + "': " + err.Error())
+	}
+	return CreateAccountResponse{account: account, err: err, loginFailed: err != nil}
 }
 
 /*
 *	Cycles through all endpoints and retrieves the Cloudant
-*	credentials for the specified app in each region.
+*	credentials for the specified app in each region. password is
+*	only used to log in to Bluemix: each account authenticates with
+*	the credentials of its own binding, and the user is asked for the
+*	Cloudant password of a binding that has none. When an IAM apikey
+*	is given the accounts authenticate with a bearer token instead
+*	of a session cookie. Regions without the app or its service are
+*	skipped, but accounts that can't be logged in to within
+*	loginTimeout are returned as LoginErrors, along with the accounts
+*	that could.
  */
-func GetCloudantAccounts(cliConnection plugin.CliConnection, httpClient *http.Client, ENDPOINTS []string, appname string, password string) ([]cam.CloudantAccount, error) {
+func GetCloudantAccounts(cliConnection plugin.CliConnection, httpClient bcr_utils.Doer, ENDPOINTS []string, appname string, password string, apikey string, loginTimeout time.Duration) ([]cam.CloudantAccount, error) {
 	var cloudantAccounts []cam.CloudantAccount
 	_, username, org, space := bcr_utils.GetCurrentTarget(cliConnection)
 	ch := make(chan CreateAccountResponse)
 	for i := 0; i < len(ENDPOINTS); i++ {
 		env, err := getAppEnv(cliConnection, username, password, org, ENDPOINTS[i], appname, space)
-		go func(cliConnection plugin.CliConnection, httpClient *http.Client, env []string, endpoint string, envErr error) {
+		cloudantPassword := ""
+		// prompt here, the accounts are created concurrently
+		if account, credErr := parseCreds(env); err == nil && credErr == nil && account.Password == "" && apikey == "" &&
+			bcr_utils.IsTerminal(os.Stdin) {
+			cloudantPassword = bcr_prompts.GetCloudantPassword("The Cloudant credentials bound in '"+terminal.ColorizeBold(ENDPOINTS[i], 36)+"' have no password.",
+				account.Username)
+		}
+		go func(cliConnection plugin.CliConnection, httpClient bcr_utils.Doer, env []string, endpoint string, envErr error, cloudantPassword string) {
 			if envErr == nil {
-				ch <- createAccount(cliConnection, httpClient, env, endpoint)
+				// buffered so that a login that times out does not block
+				created := make(chan CreateAccountResponse, 1)
+				go func() {
+					created <- createAccount(cliConnection, httpClient, env, endpoint, apikey, cloudantPassword)
+				}()
+				select {
+				case r := <-created:
+					ch <- r
+				case <-time.After(loginTimeout):
+					// a login that still succeeds must not leave its session behind
+					go func() {
+						if late := <-created; late.err == nil {
+							deleteCookies(httpClient, []cam.CloudantAccount{late.account})
+						}
+					}()
+					ch <- CreateAccountResponse{loginFailed: true, err: errors.New("Timed out logging in to Cloudant for '" +
+						terminal.ColorizeBold(endpoint, 36) + "' after " + loginTimeout.String())}
+				}
 			} else {
-				ch <- CreateAccountResponse{account: cam.CloudantAccount{}, err: err}
+				ch <- CreateAccountResponse{account: cam.CloudantAccount{}, err: envErr}
 			}
-		}(cliConnection, httpClient, env, ENDPOINTS[i], err)
+		}(cliConnection, httpClient, env, ENDPOINTS[i], err, cloudantPassword)
 	}
+	var loginErrs LoginErrors
 	responses := 0
 	for {
 		select {
 		case r := <-ch:
 			responses += 1
-			bcr_utils.CheckErrorNonFatal(r.err)
-			if r.err == nil {
+			if r.loginFailed {
+				loginErrs = append(loginErrs, r.err)
+			} else if !bcr_utils.CheckErrorNonFatal(r.err) {
 				cloudantAccounts = append(cloudantAccounts, r.account)
 			}
 		case <-time.After(50 * time.Millisecond):
@@ -69,9 +175,97 @@ func GetCloudantAccounts(cliConnection plugin.CliConnection, httpClient *http.Cl
 		}
 	}
 	close(ch)
+	if len(loginErrs) > 0 {
+		return cloudantAccounts, loginErrs
+	}
 	return cloudantAccounts, nil
 }
 
+/*
+*	Reads the Cloudant accounts listed in the JSON config file at path,
+*	in the form {"accounts": [{"name": ..., "url": ..., ...}]}, and
+*	authenticates each of them. Accounts without their own apikey use
+*	the one passed with --apikey, if any, and fall back to a session
+*	cookie otherwise.
+ */
+func GetAccountsFromConfig(httpClient bcr_utils.Doer, path string, apikey string) ([]cam.CloudantAccount, error) {
+	var cloudantAccounts []cam.CloudantAccount
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cloudantAccounts, err
+	}
+	var config struct {
+		Accounts []accountConfig `json:"accounts"`
+	}
+	if err = json.Unmarshal(contents, &config); err != nil {
+		return cloudantAccounts, errors.New("Unable to parse '" + path + "': " + err.Error())
+	}
+	for i := 0; i < len(config.Accounts); i++ {
+		account, err := configAccount(config.Accounts[i], apikey)
+		if err != nil {
+			return cloudantAccounts, errors.New("Account " + strconv.Itoa(i+1) + " in '" + path + "': " + err.Error())
+		}
+		fmt.Fprintln(bcr_utils.Out, "Authenticating with '"+terminal.ColorizeBold(account.Endpoint, 36)+"'")
+		if account.ApiKey != "" {
+			account.Token, err = getIamToken(account.ApiKey, httpClient)
+			if err != nil {
+				return cloudantAccounts, err
+			}
+		} else {
+			account.Cookie, err = getCookie(account, httpClient)
+			if err != nil {
+				return cloudantAccounts, errors.New("Unable to log in to '" + account.Endpoint + "': " + err.Error())
+			}
+		}
+		cloudantAccounts = append(cloudantAccounts, account)
+	}
+	return cloudantAccounts, nil
+}
+
+/*
+*	Builds a CloudantAccount from its config entry. The account's Url
+*	carries the credentials, like the url of a bound service does, and
+*	its name stands in for the region endpoint in messages.
+ */
+func configAccount(config accountConfig, apikey string) (cam.CloudantAccount, error) {
+	var account cam.CloudantAccount
+	u, err := url.Parse(config.Url)
+	if err != nil || u.Host == "" {
+		return account, errors.New("'" + config.Url + "' is not a valid url")
+	}
+	account.Username, account.Password = config.Username, config.Password
+	if u.User != nil {
+		password, _ := u.User.Password()
+		if account.Username == "" {
+			account.Username = u.User.Username()
+		}
+		if account.Password == "" {
+			account.Password = password
+		}
+	}
+	account.ApiKey = config.ApiKey
+	if account.ApiKey == "" {
+		account.ApiKey = apikey
+	}
+	if account.Username == "" || (account.Password == "" && account.ApiKey == "") {
+		return account, errors.New("credentials incomplete")
+	}
+	if account.Password != "" {
+		u.User = url.UserPassword(account.Username, account.Password)
+	}
+	account.Url = strings.TrimSuffix(u.String(), "/")
+	account.Endpoint = config.Name
+	if account.Endpoint == "" {
+		account.Endpoint = u.Host
+	}
+	return account, nil
+}
+
+/*
+*	Reads the credentials of the Cloudant service bound in env. The
+*	username and password are taken from the url when the binding
+*	has no separate fields for them. The password may be missing.
+ */
 func parseCreds(env []string) (cam.CloudantAccount, error) {
 	var account cam.CloudantAccount
 	for i := 0; i < len(env); i++ {
@@ -79,28 +273,74 @@ func parseCreds(env []string) (cam.CloudantAccount, error) {
 			user_reg, _ := regexp.Compile("\"username\": \"([\x00-\x7F]+)\"")
 			pass_reg, _ := regexp.Compile("\"password\": \"([\x00-\x7F]+)\"")
 			url_reg, _ := regexp.Compile("\"url\": \"([\x00-\x7F]+)\"")
-			account.Username = strings.Split(user_reg.FindString(env[i]), "\"")[3]
-			account.Password = strings.Split(pass_reg.FindString(env[i]), "\"")[3]
-			account.Url = strings.Split(url_reg.FindString(env[i]), "\"")[3]
+			account.Username = findCred(user_reg, env[i])
+			account.Password = findCred(pass_reg, env[i])
+			account.Url = findCred(url_reg, env[i])
 			break
 		}
 	}
-	if account.Username == "" || account.Password == "" || account.Url == "" {
+	if account.Url == "" {
+		return account, errors.New("Cloudant credentials incomplete\n")
+	}
+	// every request is sent to the host of the url
+	u, err := url.Parse(account.Url)
+	if err != nil || u.Host == "" {
+		return account, errors.New("The url in the Cloudant credentials is not valid\n")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		if account.Username == "" {
+			account.Username = u.User.Username()
+		}
+		if account.Password == "" {
+			account.Password = password
+		}
+	}
+	if account.Username == "" {
 		return account, errors.New("Cloudant credentials incomplete\n")
 	}
 	return account, nil
 }
 
+/*
+*	Returns the databases listed in the app's CLOUDANT_SYNC_DBS
+*	environment variable, set with "cf set-env APP CLOUDANT_SYNC_DBS
+*	db1,db2", which "cf env" lists among the user-provided variables.
+ */
+func parseDatabases(env []string) []string {
+	var dbs []string
+	dbs_reg, _ := regexp.Compile("CLOUDANT_SYNC_DBS\"?: \"?([^\"\n]+)")
+	for i := 0; i < len(env); i++ {
+		if match := dbs_reg.FindStringSubmatch(env[i]); match != nil {
+			for _, db := range strings.Split(match[1], ",") {
+				if db = strings.TrimSpace(db); db != "" {
+					dbs = append(dbs, db)
+				}
+			}
+			break
+		}
+	}
+	return dbs
+}
+
+func findCred(reg *regexp.Regexp, env string) string {
+	parts := strings.Split(reg.FindString(env), "\"")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
 /*
 *	Returns the result of "cf env APP"
  */
 func getAppEnv(cliConnection plugin.CliConnection, username string, password string, org string, endpoint string, appname string, space string) ([]string, error) {
-	fmt.Println("Retrieving CloudantNoSQLDB credentials for '" + terminal.ColorizeBold(appname, 36) + "' in '" + terminal.ColorizeBold(endpoint, 36) + "'\n")
+	fmt.Fprintln(bcr_utils.Out, "Retrieving CloudantNoSQLDB credentials for '"+terminal.ColorizeBold(appname, 36)+"' in '"+terminal.ColorizeBold(endpoint, 36)+"'\n")
 	startingEndpoint, _ := cliConnection.ApiEndpoint()
 	if startingEndpoint != endpoint {
 		_, err := cliConnection.CliCommandWithoutTerminalOutput("login", "-u", username, "-p", password, "-o", org, "-a", endpoint, "-s", space)
 		if err != nil {
-			fmt.Println("Unable to log in to org '" + terminal.ColorizeBold(org, 36) + "' and/or space '" + terminal.ColorizeBold(space, 36) + "'\n")
+			fmt.Fprintln(bcr_utils.Out, "Unable to log in to org '"+terminal.ColorizeBold(org, 36)+"' and/or space '"+terminal.ColorizeBold(space, 36)+"'\n")
 			_, err = cliConnection.CliCommand("login", "-u", username, "-p", password, "-a", endpoint)
 			bcr_utils.CheckErrorFatal(err)
 		}
@@ -113,17 +353,94 @@ func getAppEnv(cliConnection plugin.CliConnection, username string, password str
 	return output, err
 }
 
+/*
+*	Asks the UAA server of endpoint for a token the way "cf login"
+*	does, without changing the cf target, and reports whether it
+*	turned the credentials down. An endpoint that can't be reached is
+*	left for the login itself to report.
+ */
+func RejectsPassword(httpClient bcr_utils.Doer, endpoint string, username string, password string) bool {
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", endpoint+"/v2/info", "", map[string]string{"Accept": "application/json"})
+	if err != nil {
+		return false
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var info struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+	}
+	json.Unmarshal(respBody, &info)
+	if info.AuthorizationEndpoint == "" {
+		return false
+	}
+	body := url.Values{"grant_type": {"password"}, "username": {username}, "password": {password}}.Encode()
+	// the cf CLI's own client, which has no secret
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Accept": "application/json",
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("cf:"))}
+	resp, err = bcr_utils.MakeRequest(httpClient, "POST", info.AuthorizationEndpoint+"/oauth/token", body, headers)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == 401
+}
+
 /*
 *	Gets cookie for a specified CloudantAccount. This cookie is
 *	used to authenticate all necessary api calls.
  */
-func getCookie(account cam.CloudantAccount, httpClient *http.Client) string {
-	url := "https://" + account.Username + ".cloudant.com/_session"
-	body := "name=" + account.Username + "&password=" + account.Password
+func getCookie(account cam.CloudantAccount, httpClient bcr_utils.Doer) (string, error) {
+	sessionUrl := bcr_utils.GetApiUrl(account) + "/_session"
+	// passwords may contain & or =, so the form has to be encoded
+	body := url.Values{"name": {account.Username}, "password": {account.Password}}.Encode()
 	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
-	resp, err := bcr_utils.MakeRequest(httpClient, "POST", url, body, headers)
-	bcr_utils.CheckErrorFatal(err)
-	cookie := resp.Header.Get("Set-Cookie")
-	resp.Body.Close()
-	return cookie
+	resp, err := bcr_utils.MakeRequest(httpClient, "POST", sessionUrl, body, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errors.New("session request failed (" + resp.Status + ")")
+	}
+	return resp.Header.Get("Set-Cookie"), nil
+}
+
+/*
+*	Ends the sessions of accounts that are given up on before they are
+*	handed back, so that their cookies don't stay valid
+ */
+func deleteCookies(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount) {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Cookie == "" {
+			continue
+		}
+		url := bcr_utils.GetApiUrl(cloudantAccounts[i]) + "/_session"
+		resp, err := bcr_utils.MakeCleanupRequest(httpClient, "DELETE", url, "", bcr_utils.AuthHeaders(cloudantAccounts[i], nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+/*
+*	Exchanges an IAM API key for a bearer token. The token is used
+*	in place of a session cookie to authenticate all necessary api calls.
+ */
+func getIamToken(apikey string, httpClient bcr_utils.Doer) (string, error) {
+	body := url.Values{"grant_type": {"urn:ibm:params:oauth:grant-type:apikey"}, "apikey": {apikey}}.Encode()
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded", "Accept": "application/json"}
+	resp, err := bcr_utils.MakeRequest(httpClient, "POST", IAM_TOKEN_URL, body, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.Unmarshal(respBody, &token)
+	if resp.StatusCode != 200 || token.AccessToken == "" {
+		return "", errors.New("Unable to exchange the IAM API key for a token (" + resp.Status + ")")
+	}
+	return token.AccessToken, nil
 }
@@ -0,0 +1,34 @@
+package ca
+
+import (
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetCookieEncodesPassword(t *testing.T) {
+	password := "p&ss=w+rd% ?#"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/_session" {
+			t.Errorf("sent %s %s, want POST /_session", r.Method, r.URL.Path)
+		}
+		r.ParseForm()
+		if len(r.PostForm) != 2 || r.PostForm.Get("name") != "alice" || r.PostForm.Get("password") != password {
+			t.Errorf("sent the form %v", r.PostForm)
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Set-Cookie", "AuthSession=alice")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+	account := cam.CloudantAccount{Username: "alice", Password: password, Url: server.URL}
+	cookie, err := getCookie(account, server.Client())
+	if err != nil {
+		t.Fatalf("getCookie failed: %v", err)
+	}
+	if cookie != "AuthSession=alice" {
+		t.Errorf("got the cookie %q", cookie)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"strconv"
+)
+
+/*
+*	The size of one database in one account, as reported by a GET
+*	on the database. reason says why it could not be read.
+ */
+type databaseSize struct {
+	endpoint string
+	docs     int64
+	bytes    int64
+	reason   string
+}
+
+/*
+*	With --estimate, prints how many documents and how much data each
+*	of dbs holds in every account, as a sense of how much there is to
+*	replicate. Accounts that do not allow reading a database's info
+*	are reported and skipped.
+ */
+func printEstimate(dbs []string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) {
+	if !flags.Estimate {
+		return
+	}
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nESTIMATE", 35)+"\n")
+	var totalDocs, totalBytes int64
+	for i := 0; i < len(dbs); i++ {
+		ch := make(chan databaseSize, len(cloudantAccounts))
+		for j := 0; j < len(cloudantAccounts); j++ {
+			go func(account cam.CloudantAccount) {
+				ch <- getDatabaseSize(bcr_replication.AccountDatabase(dbs[i], account, flags), httpClient, account, flags)
+			}(cloudantAccounts[j])
+		}
+		fmt.Fprintln(bcr_utils.Out, "'"+terminal.ColorizeBold(dbs[i], 36)+"'")
+		for j := 0; j < len(cloudantAccounts); j++ {
+			size := <-ch
+			if size.reason != "" {
+				fmt.Fprintln(bcr_utils.Out, "    "+size.endpoint+": "+terminal.ColorizeBold("unknown", 33)+" ("+size.reason+")")
+				continue
+			}
+			totalDocs += size.docs
+			totalBytes += size.bytes
+			fmt.Fprintln(bcr_utils.Out, "    "+size.endpoint+": "+strconv.FormatInt(size.docs, 10)+" documents, "+formatBytes(size.bytes))
+		}
+	}
+	fmt.Fprintln(bcr_utils.Out, "\nIn total "+strconv.FormatInt(totalDocs, 10)+" documents, "+formatBytes(totalBytes))
+}
+
+/*
+*	Reads doc_count and the size of the data in db, preferring
+*	sizes.external and falling back to the older data_size
+ */
+func getDatabaseSize(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, flags bcr_utils.Flags) databaseSize {
+	size := databaseSize{endpoint: account.Endpoint}
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", bcr_utils.GetApiUrl(account)+"/"+bcr_utils.DatabasePath(db), "", nil, account, flags.MaxRetries)
+	if err != nil {
+		size.reason = err.Error()
+		return size
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		size.reason = resp.Status
+		return size
+	}
+	var info struct {
+		DocCount int64 `json:"doc_count"`
+		DataSize int64 `json:"data_size"`
+		Sizes    struct {
+			External int64 `json:"external"`
+		} `json:"sizes"`
+	}
+	if json.Unmarshal(respBody, &info) != nil {
+		size.reason = "unexpected response"
+		return size
+	}
+	size.docs, size.bytes = info.DocCount, info.Sizes.External
+	if size.bytes == 0 {
+		size.bytes = info.DataSize
+	}
+	return size
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[unit]
+}
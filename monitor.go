@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"strconv"
+	"time"
+)
+
+/*
+*	Polls the _replicator databases every --interval seconds and prints
+*	each change in the state of the selected databases' replications,
+*	until all of them are triggered or completed. Returns false if that
+*	does not happen within --max-wait seconds.
+ */
+func monitorReplication(cliConnection plugin.CliConnection, args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password, endpoints := setup(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := getCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+	bcr_utils.CheckErrorFatal(err)
+	dbs := selectDatabases(httpClient, cloudantAccounts, flags)
+	healthy := watchReplicationStates(dbs, httpClient, cloudantAccounts, flags)
+	endSessions(httpClient, cloudantAccounts, flags)
+	return healthy
+}
+
+func watchReplicationStates(dbs []string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nMONITORING", 35)+"\n")
+	deadline := time.Now().Add(time.Duration(flags.MaxWait) * time.Second)
+	previous := make(map[string]string)
+	for {
+		states := getReplicationStates(httpClient, cloudantAccounts, flags)
+		healthy := true
+		for i := 0; i < len(dbs); i++ {
+			for j := 0; j < len(cloudantAccounts); j++ {
+				for k := 0; k < len(cloudantAccounts); k++ {
+					source, target := cloudantAccounts[j], cloudantAccounts[k]
+					if j == k || !bcr_replication.Replicates(source, target, flags) {
+						continue
+					}
+					state := replicationState(dbs[i], states, source, target, flags)
+					healthy = healthy && healthyState(state)
+					link := "'" + terminal.ColorizeBold(dbs[i], 36) + "' " + source.Endpoint + " -> " + target.Endpoint
+					if previous[link] != state {
+						previous[link] = state
+						if !healthyState(state) {
+							state = terminal.Colorize(state, 31)
+						}
+						fmt.Fprintln(bcr_utils.Out, time.Now().Format("15:04:05")+"  "+link+": "+state)
+					}
+				}
+			}
+		}
+		if healthy {
+			fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nAll replications are triggered or completed", 32))
+			return true
+		}
+		if time.Now().After(deadline) {
+			bcr_utils.CheckErrorNonFatal(errors.New("Not all replications were triggered or completed after " +
+				strconv.Itoa(flags.MaxWait) + " seconds"))
+			return false
+		}
+		select {
+		case <-bcr_utils.Ctx.Done():
+			return false
+		case <-time.After(time.Duration(flags.Interval) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"strconv"
+	"strings"
+)
+
+/*
+*	With --new-only, leaves out the databases that already have a
+*	replication document between any two of the accounts, so that only
+*	databases added since the last run are synced. Replicator
+*	databases that can't be read count as holding no documents.
+*	Returns dbs unchanged without --new-only.
+ */
+func newDatabases(dbs []string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []string {
+	if !flags.NewOnly {
+		return dbs
+	}
+	states := getReplicationStates(httpClient, cloudantAccounts, flags)
+	var added []string
+	for i := 0; i < len(dbs); i++ {
+		if !isReplicated(dbs[i], states, cloudantAccounts, flags) {
+			added = append(added, dbs[i])
+		}
+	}
+	if len(added) == 0 {
+		fmt.Fprintln(bcr_utils.Out, "All "+strconv.Itoa(len(dbs))+" selected database(s) are already replicated. Nothing new to sync.")
+		return added
+	}
+	fmt.Fprintln(bcr_utils.Out, "Syncing "+terminal.ColorizeBold(strconv.Itoa(len(added)), 36)+" new database(s) of the "+
+		strconv.Itoa(len(dbs))+" selected: "+terminal.ColorizeBold(strings.Join(added, ","), 36)+"\n")
+	return added
+}
+
+/*
+*	Reports whether a replication document for db exists between any
+*	two of the accounts
+ */
+func isReplicated(db string, states map[string]map[string]string, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if !bcr_replication.Replicates(cloudantAccounts[j], cloudantAccounts[i], flags) {
+				continue
+			}
+			state := replicationState(db, states, cloudantAccounts[j], cloudantAccounts[i], flags)
+			if state != "missing" && state != "unknown" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/cloudfoundry/cli/plugin"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
-	"net/http"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -18,29 +18,99 @@ func init() {
 	terminal.InitColorSupport()
 }
 
-func GetPassword() string {
+/*
+*	Asks for the Bluemix password without echoing it. With confirm
+*	it has to be typed twice, and is asked for again until both
+*	entries match.
+ */
+func GetPassword(confirm bool) string {
 	fmt.Print("\nBluemix password to log in across multiple regions.\n")
 	reader := bufio.NewReader(os.Stdin)
 	bucket := &[]string{}
 	printer := terminal.NewTeePrinter()
 	printer.SetOutputBucket(bucket)
 	ui := terminal.NewUI(reader, printer)
-	pw := ui.AskForPassword("Password")
-	fmt.Println("\n")
+	for {
+		pw := ui.AskForPassword("Password")
+		if !confirm || ui.AskForPassword("Confirm password") == pw {
+			fmt.Println()
+			return string(pw)
+		}
+		fmt.Print("\nThe passwords do not match. Please try again.\n")
+	}
+}
+
+/*
+*	Asks for the Cloudant password of username after printing why it
+*	is needed, e.g. because the credentials bound in an endpoint have
+*	none, or because the account cache never holds passwords
+ */
+func GetCloudantPassword(reason string, username string) string {
+	fmt.Print("\n" + reason + "\n")
+	reader := bufio.NewReader(os.Stdin)
+	bucket := &[]string{}
+	printer := terminal.NewTeePrinter()
+	printer.SetOutputBucket(bucket)
+	ui := terminal.NewUI(reader, printer)
+	pw := ui.AskForPassword("Password for '" + username + "'")
+	fmt.Println()
 	return string(pw)
 }
 
+/*
+*	Reads a single line from stdin as the password, for use with
+*	--password-stdin. Nothing is echoed back.
+ */
+func ReadPasswordFromStdin() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	pw, err := reader.ReadString('\n')
+	pw = strings.TrimRight(pw, "\r\n")
+	if pw == "" {
+		if err == nil || err == io.EOF {
+			err = errors.New("No password was provided on stdin")
+		}
+		return "", err
+	}
+	return pw, nil
+}
+
+/*
+*	Asks a yes/no question, answering no unless the user
+*	types y or yes
+ */
+func Confirm(question string) bool {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("\n" + question + " [y/N]" + terminal.ColorizeBold("> ", 36))
+	answer, _, _ := reader.ReadLine()
+	fmt.Println()
+	answer_str := strings.ToLower(strings.TrimSpace(string(answer)))
+	return answer_str == "y" || answer_str == "yes"
+}
+
 /*
 *	Lists all databases for a specified CloudantAccount and
-*	prompts the user to select one
+*	prompts the user to select one. If none of the accounts can
+*	be reached the user is asked whether to try again.
  */
-func GetDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) ([]string, error) {
+func GetDatabases(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount) ([]string, error) {
 	reader := bufio.NewReader(os.Stdin)
-	all_dbs := bcr_utils.GetAllDatabases(httpClient, cloudantAccounts)
+	var all_dbs, listed_by []string
+	for {
+		all_dbs, listed_by = bcr_utils.ListAllDatabases(httpClient, cloudantAccounts)
+		if len(listed_by) > 0 || !Confirm("None of the CloudantNoSQLDB services could be reached. Try again?") {
+			break
+		}
+	}
+	if len(listed_by) == 0 {
+		return all_dbs, errors.New("Unable to list databases for CloudantNoSQLDB services in any region")
+	}
 	if len(all_dbs) == 0 {
 		return all_dbs, errors.New("No databases found for CloudantNoSQLDB services in any region")
 	}
-	fmt.Println("Current databases across all regions:\n")
+	for i := 0; i < len(listed_by); i++ {
+		listed_by[i] = "'" + terminal.ColorizeBold(listed_by[i], 36) + "'"
+	}
+	fmt.Println("Current databases across all regions, as listed by " + strings.Join(listed_by, ", ") + ":\n")
 	for i := 0; i < len(all_dbs); i++ {
 		fmt.Println(strconv.Itoa(i+1) + ". " + terminal.ColorizeBold(all_dbs[i], 36))
 	}
@@ -0,0 +1,319 @@
+package bcr_replication
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	bcr_utils.Out, bcr_utils.Errors = ioutil.Discard, ioutil.Discard
+	os.Exit(m.Run())
+}
+
+/*
+*	A Cloudant account served by an httptest server, implementing the
+*	parts of the API the replicator uses: _session, _all_dbs, creating
+*	databases, the _api/v2 _security endpoint and documents.
+ */
+type fakeCloudant struct {
+	*httptest.Server
+	username string
+	password string
+	// answers "METHOD /escaped/path" with the status instead, or
+	// closes the connection if it is negative
+	fail map[string]int
+	// how long POSTs to the _replicator database take
+	delay time.Duration
+
+	lock     sync.Mutex
+	dbs      map[string]bool
+	security map[string]string
+	docs     map[string]map[string]interface{}
+	requests []string
+	bodies   map[string][]string
+}
+
+func newFakeCloudant(username string, password string) *fakeCloudant {
+	f := &fakeCloudant{username: username, password: password, fail: make(map[string]int), dbs: make(map[string]bool),
+		security: make(map[string]string), docs: make(map[string]map[string]interface{}), bodies: make(map[string][]string)}
+	f.Server = httptest.NewTLSServer(f)
+	return f
+}
+
+func (f *fakeCloudant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	key := r.Method + " " + r.URL.EscapedPath()
+	if f.delay > 0 && r.Method == "POST" && r.URL.EscapedPath() == "/_replicator" {
+		time.Sleep(f.delay)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, key)
+	f.bodies[key] = append(f.bodies[key], string(body))
+	if status, ok := f.fail[key]; ok {
+		if status < 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		writeJson(w, status, map[string]interface{}{"error": "injected", "reason": "failure injected by the test"})
+		return
+	}
+	var parts []string
+	for _, part := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, _ := url.PathUnescape(part)
+		parts = append(parts, unescaped)
+	}
+	if parts[0] == "_session" {
+		f.session(w, r, string(body))
+		return
+	}
+	if r.Header.Get("Cookie") != "AuthSession="+f.username {
+		writeJson(w, 401, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+	switch {
+	case parts[0] == "_all_dbs" && r.Method == "GET":
+		var dbs []string
+		for db := range f.dbs {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+		writeJson(w, 200, dbs)
+	case len(parts) == 5 && parts[0] == "_api" && parts[4] == "_security":
+		f.securityDocument(w, r, parts[3], string(body))
+	case len(parts) == 1:
+		f.database(w, r, parts[0], string(body))
+	case len(parts) == 2:
+		f.document(w, r, parts[0], parts[1], string(body))
+	default:
+		writeJson(w, 404, map[string]interface{}{"error": "not_found"})
+	}
+}
+
+func (f *fakeCloudant) session(w http.ResponseWriter, r *http.Request, body string) {
+	if r.Method == "DELETE" {
+		writeJson(w, 200, map[string]interface{}{"ok": true})
+		return
+	}
+	form, _ := url.ParseQuery(body)
+	if form.Get("name") != f.username || form.Get("password") != f.password {
+		writeJson(w, 401, map[string]interface{}{"error": "unauthorized"})
+		return
+	}
+	w.Header().Set("Set-Cookie", "AuthSession="+f.username+"; Version=1; Path=/; HttpOnly")
+	writeJson(w, 200, map[string]interface{}{"ok": true, "name": f.username})
+}
+
+func (f *fakeCloudant) securityDocument(w http.ResponseWriter, r *http.Request, db string, body string) {
+	if !f.dbs[db] {
+		writeJson(w, 404, map[string]interface{}{"error": "not_found", "reason": "Database does not exist."})
+		return
+	}
+	switch r.Method {
+	case "GET":
+		doc := f.security[db]
+		if doc == "" {
+			doc = "{}"
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(doc))
+	case "PUT":
+		f.security[db] = body
+		writeJson(w, 200, map[string]interface{}{"ok": true})
+	}
+}
+
+func (f *fakeCloudant) database(w http.ResponseWriter, r *http.Request, db string, body string) {
+	switch r.Method {
+	case "PUT":
+		if f.dbs[db] {
+			writeJson(w, 412, map[string]interface{}{"error": "file_exists"})
+			return
+		}
+		f.dbs[db] = true
+		writeJson(w, 201, map[string]interface{}{"ok": true})
+	case "POST":
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(body), &doc)
+		id, _ := doc["_id"].(string)
+		if !f.dbs[db] {
+			writeJson(w, 404, map[string]interface{}{"error": "not_found"})
+			return
+		}
+		if f.docs[db+"/"+id] != nil {
+			writeJson(w, 409, map[string]interface{}{"error": "conflict"})
+			return
+		}
+		doc["_rev"] = "1-fake"
+		f.docs[db+"/"+id] = doc
+		writeJson(w, 201, map[string]interface{}{"ok": true, "id": id, "rev": "1-fake"})
+	default:
+		writeJson(w, 404, map[string]interface{}{"error": "not_found"})
+	}
+}
+
+func (f *fakeCloudant) document(w http.ResponseWriter, r *http.Request, db string, id string, body string) {
+	doc := f.docs[db+"/"+id]
+	switch r.Method {
+	case "GET":
+		if doc == nil {
+			writeJson(w, 404, map[string]interface{}{"error": "not_found", "reason": "missing"})
+			return
+		}
+		writeJson(w, 200, doc)
+	case "PUT":
+		json.Unmarshal([]byte(body), &doc)
+		doc["_rev"] = "2-fake"
+		f.docs[db+"/"+id] = doc
+		writeJson(w, 201, map[string]interface{}{"ok": true, "id": id, "rev": "2-fake"})
+	case "DELETE":
+		delete(f.docs, db+"/"+id)
+		writeJson(w, 200, map[string]interface{}{"ok": true})
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	bd, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bd)
+}
+
+/*
+*	Returns the requests the account received, as "METHOD /path"
+ */
+func (f *fakeCloudant) received() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+/*
+*	Returns the bodies of the requests sent as key, "METHOD /path"
+ */
+func (f *fakeCloudant) bodiesOf(key string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.bodies[key]...)
+}
+
+func (f *fakeCloudant) doc(db string, id string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.docs[db+"/"+id]
+}
+
+func (f *fakeCloudant) docCount(db string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	count := 0
+	for key := range f.docs {
+		if strings.HasPrefix(key, db+"/") {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (f *fakeCloudant) securityOf(db string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(f.security[db]), &doc)
+	return doc
+}
+
+/*
+*	Sends requests through client, recording every url and the most
+*	POSTs to a _replicator database that were in flight at once
+ */
+type recordingClient struct {
+	client   *http.Client
+	lock     sync.Mutex
+	urls     []string
+	posts    int
+	maxPosts int
+}
+
+func (c *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	post := req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/_replicator")
+	c.lock.Lock()
+	c.urls = append(c.urls, req.URL.String())
+	if post {
+		c.posts += 1
+		if c.posts > c.maxPosts {
+			c.maxPosts = c.posts
+		}
+	}
+	c.lock.Unlock()
+	resp, err := c.client.Do(req)
+	if post {
+		c.lock.Lock()
+		c.posts -= 1
+		c.lock.Unlock()
+	}
+	return resp, err
+}
+
+/*
+*	One fake Cloudant account per region, each served at
+*	https://cloudant-REGION.example.com by its own server, whose
+*	hosts differ from the accounts' usernames
+ */
+type fakeCluster struct {
+	servers  []*fakeCloudant
+	accounts []cam.CloudantAccount
+	client   *recordingClient
+}
+
+func newFakeCluster(t *testing.T, regions ...string) *fakeCluster {
+	c := &fakeCluster{}
+	addrs := make(map[string]string)
+	roots := x509.NewCertPool()
+	for i := 0; i < len(regions); i++ {
+		username := "user-" + regions[i]
+		f := newFakeCloudant(username, "pass&word="+regions[i])
+		t.Cleanup(f.Close)
+		host := "cloudant-" + regions[i] + ".example.com"
+		addrs[host+":443"] = f.Listener.Addr().String()
+		roots.AddCert(f.Certificate())
+		c.servers = append(c.servers, f)
+		c.accounts = append(c.accounts, cam.CloudantAccount{Endpoint: "https://api." + regions[i] + ".bluemix.net", Username: username,
+			Password: f.password, Url: "https://" + username + ":" + url.QueryEscape(f.password) + "@" + host, Cookie: "AuthSession=" + username})
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addrs[addr])
+		},
+	}
+	transport.TLSClientConfig = bcr_utils.NewHttpClient(nil, nil).Transport.(*http.Transport).TLSClientConfig.Clone()
+	transport.TLSClientConfig.RootCAs = roots
+	c.client = &recordingClient{client: &http.Client{Transport: transport, Timeout: 10 * time.Second}}
+	return c
+}
+
+/*
+*	Creates db in every account
+ */
+func (c *fakeCluster) createDatabase(db string) {
+	for i := 0; i < len(c.servers); i++ {
+		c.servers[i].lock.Lock()
+		c.servers[i].dbs[db] = true
+		c.servers[i].lock.Unlock()
+	}
+}
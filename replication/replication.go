@@ -0,0 +1,1246 @@
+package bcr_replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*	The settings of a sync: those of cloudant-replicate's flags that
+*	concern the databases and replications themselves, onto which
+*	cloudant-replicate maps its command line. Start from DefaultOptions
+*	rather than the zero value.
+ */
+type Options struct {
+	ReplicatorDb      string
+	IdPrefix          string
+	Create            bool
+	DryRun            bool
+	OnlyPermissions   bool
+	SkipPermissions   bool
+	Verify            bool
+	CleanupOnFailure  bool
+	MaxRetries        int
+	Concurrency       int
+	ParallelDbs       bool
+	ParallelAccounts  int
+	DbMap             map[string]string
+	GrantAs           map[string]string
+	GrantRoles        []string
+	Owner             string
+	Topology          string
+	Hub               string
+	SourceRegion      string
+	Once              bool
+	PushOnce          bool
+	PullOnce          bool
+	Filter            string
+	PushFilter        string
+	PullFilter        string
+	QueryParams       map[string]interface{}
+	NoDdocs           bool
+	NoCheckpoints     bool
+	SinceSeq          string
+	WorkerProcesses   int
+	ConnectionTimeout int
+	ReplicatorOptions map[string]interface{}
+}
+
+// returned along with the report of a sync in which any request failed
+var ErrIncomplete = errors.New("Not every request of the sync succeeded")
+
+// the clock replication documents are stamped with, fixed by tests
+var now = time.Now
+
+func DefaultOptions() Options {
+	flags := bcr_utils.DefaultFlags()
+	return Options{ReplicatorDb: flags.ReplicatorDb, MaxRetries: flags.MaxRetries, Concurrency: flags.Concurrency,
+		GrantRoles: flags.GrantRoles}
+}
+
+/*
+*	The flags the steps of a sync are run with, which are the default
+*	ones but for opts
+ */
+func (opts Options) flags() bcr_utils.Flags {
+	flags := bcr_utils.DefaultFlags()
+	flags.ReplicatorDb, flags.IdPrefix = opts.ReplicatorDb, opts.IdPrefix
+	flags.Create, flags.DryRun, flags.Verify = opts.Create, opts.DryRun, opts.Verify
+	flags.OnlyPermissions, flags.SkipPermissions = opts.OnlyPermissions, opts.SkipPermissions
+	flags.CleanupOnFailure, flags.MaxRetries = opts.CleanupOnFailure, opts.MaxRetries
+	flags.Concurrency, flags.ParallelDbs, flags.ParallelAccounts = opts.Concurrency, opts.ParallelDbs, opts.ParallelAccounts
+	flags.DbMap, flags.GrantAs, flags.GrantRoles, flags.Owner = opts.DbMap, opts.GrantAs, opts.GrantRoles, opts.Owner
+	flags.Topology, flags.Hub, flags.SourceRegion = opts.Topology, opts.Hub, opts.SourceRegion
+	flags.Once, flags.PushOnce, flags.PullOnce = opts.Once, opts.PushOnce, opts.PullOnce
+	flags.Filter, flags.PushFilter, flags.PullFilter, flags.QueryParams = opts.Filter, opts.PushFilter, opts.PullFilter, opts.QueryParams
+	flags.NoDdocs, flags.NoCheckpoints, flags.SinceSeq = opts.NoDdocs, opts.NoCheckpoints, opts.SinceSeq
+	flags.WorkerProcesses, flags.ConnectionTimeout = opts.WorkerProcesses, opts.ConnectionTimeout
+	flags.ReplicatorOptions = opts.ReplicatorOptions
+	return flags
+}
+
+/*
+*	What an earlier run already did for one database: whether every
+*	account grants the access shareDatabases would, and whether every
+*	replication document createReplicationDocuments would create exists
+ */
+type Progress struct {
+	Shared     bool
+	Replicated bool
+}
+
+/*
+*	Sets up replication of dbs between cloudantAccounts, which must
+*	already be logged in to, e.g. by ca.GetCloudantAccounts or
+*	ca.GetAccountsFromConfig. This is what cloudant-replicate does
+*	once it has found the accounts and databases, without the Bluemix
+*	login or any prompts, for programs embedding the replicator.
+*	Sync leaves the settings in bcr_utils alone: its output goes to
+*	bcr_utils.Out and Errors, and its requests are cancelled with
+*	bcr_utils.Ctx, whatever they are set to.
+ */
+func Sync(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, dbs []string, opts Options) (Report, error) {
+	return Resume(httpClient, cloudantAccounts, dbs, nil, opts)
+}
+
+/*
+*	Runs the replication pipeline shared by cloudant-replicate and
+*	cloudant-replicate-accounts for every database: creates the
+*	_replicator databases, the databases themselves with --create,
+*	shares them and creates the replication documents. --only-permissions
+*	and --skip-permissions limit this to, or leave out, the sharing. Returns the
+*	results per database, and ErrIncomplete if any request failed. With
+*	--parallel-dbs up to --concurrency databases are worked on at once, and
+*	what plan says an earlier run finished is left out. With --cleanup-on-failure
+*	the replication documents created by a run that failed are deleted again.
+ */
+func Resume(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, dbs []string, plan map[string]Progress, opts Options) (Report, error) {
+	flags := opts.flags()
+	var all []bcr_utils.HttpResponse
+	var replicators []ReplicatorResult
+	var unavailable []string
+	if !flags.OnlyPermissions {
+		bcr_utils.Emit("phase_started", map[string]interface{}{"phase": "replicator databases"})
+		replicators, all = createReplicatorDatabases(httpClient, cloudantAccounts, flags)
+		for i := 0; i < len(replicators); i++ {
+			bcr_utils.Emit("replicator_database", map[string]interface{}{"account": replicators[i].Account, "outcome": replicators[i].Outcome})
+			if replicators[i].Outcome == "failed" {
+				unavailable = append(unavailable, replicators[i].Account)
+				fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" the "+flags.ReplicatorDb+" database is not available in '"+
+					terminal.ColorizeBold(replicators[i].Account, 36)+"'. No replications into it will be created.")
+			}
+		}
+	}
+	var results []DatabaseResult
+	// caps the number of replication documents being created at once,
+	// across all the databases worked on side by side
+	docSlots := make(chan struct{}, flags.Concurrency)
+	if flags.ParallelDbs {
+		var responses []bcr_utils.HttpResponse
+		results, responses = replicateDatabasesConcurrently(dbs, plan, httpClient, cloudantAccounts, unavailable, docSlots, flags)
+		all = append(all, responses...)
+	} else {
+		// after Ctrl-C the remaining databases are left alone
+		for i := 0; i < len(dbs) && bcr_utils.Ctx.Err() == nil; i++ {
+			result, responses := replicateDatabase(dbs[i], plan[dbs[i]], httpClient, cloudantAccounts, unavailable, docSlots, flags)
+			results = append(results, result)
+			all = append(all, responses...)
+		}
+	}
+	if !flags.OnlyPermissions && !flags.DryRun {
+		fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nREPLICATIONS", 35)+"\n")
+		for i := 0; i < len(results); i++ {
+			c := results[i].Counts
+			fmt.Fprintln(bcr_utils.Out, "'"+terminal.ColorizeBold(results[i].Name, 36)+"': created "+strconv.Itoa(c.Created)+
+				", updated "+strconv.Itoa(c.Updated)+", already existed "+strconv.Itoa(c.Existing)+", failed "+strconv.Itoa(c.Failed))
+		}
+	}
+	if len(results) < len(dbs) {
+		fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("\nWARNING", 33)+" the run was cut short before these databases were processed:")
+		for i := 0; i < len(dbs); i++ {
+			processed := false
+			for j := 0; j < len(results); j++ {
+				processed = processed || results[j].Name == dbs[i]
+			}
+			if !processed {
+				fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold(dbs[i], 36))
+			}
+		}
+	}
+	bcr_utils.PrintFailureSummary(all)
+	failed := HasErrors(all) || len(results) < len(dbs)
+	if failed && flags.CleanupOnFailure && !flags.DryRun {
+		rollBackReplications(all, httpClient, cloudantAccounts, flags)
+	}
+	bcr_utils.Emit("sync_finished", map[string]interface{}{"success": !failed, "databases": len(results)})
+	report := Report{Replicators: replicators, Databases: results, Success: !failed}
+	if failed {
+		return report, ErrIncomplete
+	}
+	return report, nil
+}
+
+/*
+*	Deletes the replication documents that responses show were created
+*	by this run, using the _rev Cloudant returned for each of them. The
+*	requests go through even after Ctrl-C or --deadline.
+ */
+func rollBackReplications(responses []bcr_utils.HttpResponse, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nROLLING BACK", 35)+"\n")
+	deletes := make(chan bcr_utils.HttpResponse, len(responses))
+	var wg sync.WaitGroup
+	numCalls := 0
+	for i := 0; i < len(responses); i++ {
+		r := responses[i]
+		if r.RequestType != "POST" || r.Id == "" || replicationOutcome(r) != "created" {
+			continue
+		}
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if cloudantAccounts[j].Endpoint != r.Endpoint {
+				continue
+			}
+			numCalls += 1
+			wg.Add(1)
+			go func(target cam.CloudantAccount, created bcr_utils.HttpResponse) {
+				defer wg.Done()
+				defer bcr_utils.RecoverResponse(deletes, bcr_utils.HttpResponse{RequestType: "DELETE", Endpoint: target.Endpoint, Id: created.Id})
+				deletes <- deleteCreatedDocument(created, httpClient, target, flags)
+			}(cloudantAccounts[j], r)
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(deletes)
+	}()
+	results := bcr_utils.CheckHttpResponses(deletes, numCalls)
+	deleted := 0
+	for i := 0; i < len(results); i++ {
+		if results[i].Err == nil {
+			deleted += 1
+		}
+	}
+	fmt.Fprintln(bcr_utils.Out, "Deleted "+strconv.Itoa(deleted)+" of the "+strconv.Itoa(numCalls)+" replication documents created by this run")
+	return results
+}
+
+func deleteCreatedDocument(created bcr_utils.HttpResponse, httpClient bcr_utils.Doer, target cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.HttpResponse {
+	var doc struct {
+		Id  string `json:"id"`
+		Rev string `json:"rev"`
+	}
+	json.Unmarshal([]byte(created.Body), &doc)
+	if doc.Id == "" || doc.Rev == "" {
+		return bcr_utils.HttpResponse{RequestType: "DELETE", Endpoint: target.Endpoint, Id: created.Id,
+			Err: errors.New("Unable to roll back " + created.Id + " for '" + target.Endpoint + "', its _rev is unknown")}
+	}
+	url := bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), doc.Id) + "?rev=" + doc.Rev
+	resp, err := bcr_utils.MakeCleanupRequest(httpClient, "DELETE", url, "", bcr_utils.AuthHeaders(target, nil))
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "DELETE", Endpoint: target.Endpoint, Id: created.Id, Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 404 {
+		err = errors.New("Unable to roll back " + created.Id + " for '" + target.Endpoint + "'")
+	}
+	return bcr_utils.HttpResponse{RequestType: "DELETE", Status: resp.Status, Body: string(respBody), Endpoint: target.Endpoint, Id: created.Id, Err: err}
+}
+
+/*
+*	Makes sure every account has a replicator database, returning
+*	whether it was created, already existed or could not be created
+*	in each account along with the responses themselves.
+ */
+func createReplicatorDatabases(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) ([]ReplicatorResult, []bcr_utils.HttpResponse) {
+	responses := createDatabase(flags.ReplicatorDb, httpClient, cloudantAccounts, flags)
+	replicators := []ReplicatorResult{}
+	for i := 0; i < len(responses); i++ {
+		r := responses[i]
+		if r.Endpoint == "" {
+			continue
+		}
+		result := ReplicatorResult{Account: r.Endpoint, Outcome: "created", Status: r.Status}
+		switch {
+		case r.Err != nil:
+			result.Outcome, result.Error = "failed", terminal.Decolorize(r.Err.Error())
+		case strings.HasPrefix(r.Status, "412"):
+			result.Outcome = "already exists"
+		}
+		replicators = append(replicators, result)
+	}
+	return replicators, responses
+}
+
+/*
+*	Creates, shares and replicates a single database, returning its
+*	results along with every response received on the way. Whatever
+*	done says an earlier run finished is skipped. docSlots is the
+*	semaphore shared by every replication document being created.
+ */
+func replicateDatabase(db string, done Progress, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, unavailable []string, docSlots chan struct{}, flags bcr_utils.Flags) (DatabaseResult, []bcr_utils.HttpResponse) {
+	var all []bcr_utils.HttpResponse
+	bcr_utils.Emit("database_started", map[string]interface{}{"db": db})
+	// permissions could only be read if the database exists everywhere
+	if flags.Create && !flags.OnlyPermissions && !done.Shared {
+		all = append(all, createDatabase(db, httpClient, cloudantAccounts, flags)...)
+	}
+	var permissions, replications []bcr_utils.HttpResponse
+	if !flags.SkipPermissions && !done.Shared {
+		permissions = shareDatabases(db, httpClient, cloudantAccounts, flags)
+	}
+	if !flags.OnlyPermissions && !done.Replicated {
+		replications = createReplicationDocuments(db, httpClient, cloudantAccounts, unavailable, docSlots, flags)
+	}
+	if (flags.Filter != "" || flags.PushFilter != "" || flags.PullFilter != "") && !flags.DryRun && !flags.OnlyPermissions {
+		checkFilter(db, httpClient, cloudantAccounts, flags)
+	}
+	all = append(append(all, permissions...), replications...)
+	if flags.Verify && !flags.DryRun && !flags.OnlyPermissions && !HasErrors(replications) {
+		all = append(all, verifyReplication(db, httpClient, cloudantAccounts, flags)...)
+	}
+	result := DatabaseResult{Name: db, Permissions: ToRequestResults(permissions),
+		Replications: ToRequestResults(replications), Counts: countReplications(replications)}
+	if done.Replicated {
+		result.Counts.Existing = countLinks(cloudantAccounts, flags)
+	}
+	bcr_utils.Emit("database_finished", map[string]interface{}{"db": db, "counts": result.Counts, "success": !HasErrors(all)})
+	return result, all
+}
+
+type databaseWork struct {
+	index     int
+	skipped   bool
+	result    DatabaseResult
+	responses []bcr_utils.HttpResponse
+}
+
+/*
+*	Where the progress of a single database is written: bcr_utils.Out,
+*	or nowhere with --parallel-dbs
+ */
+func progressOut(flags bcr_utils.Flags) io.Writer {
+	if flags.ParallelDbs {
+		return ioutil.Discard
+	}
+	return bcr_utils.Out
+}
+
+/*
+*	The --parallel-dbs counterpart of the loop in Resume.
+*	The progress messages of databases worked on side by side would be
+*	interleaved, so they are left out (see progressOut) in favour of a
+*	line per finished database.
+*	Results are returned in the order of dbs.
+ */
+func replicateDatabasesConcurrently(dbs []string, plan map[string]Progress, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, unavailable []string, docSlots chan struct{}, flags bcr_utils.Flags) ([]DatabaseResult, []bcr_utils.HttpResponse) {
+	fmt.Fprintln(bcr_utils.Out, "\nWorking on up to "+strconv.Itoa(flags.Concurrency)+" databases at once\n")
+	ch := make(chan databaseWork)
+	// caps the number of databases being worked on at once
+	inFlight := make(chan struct{}, flags.Concurrency)
+	for i := 0; i < len(dbs); i++ {
+		go func(index int) {
+			select {
+			case inFlight <- struct{}{}:
+			case <-bcr_utils.Ctx.Done():
+				// after Ctrl-C the remaining databases are left alone
+				ch <- databaseWork{index: index, skipped: true}
+				return
+			}
+			result, responses := replicateDatabase(dbs[index], plan[dbs[index]], httpClient, cloudantAccounts, unavailable, docSlots, flags)
+			<-inFlight
+			ch <- databaseWork{index: index, result: result, responses: responses}
+		}(i)
+	}
+	done := make([]databaseWork, len(dbs))
+	var all []bcr_utils.HttpResponse
+	for finished := 0; finished < len(dbs); finished++ {
+		w := <-ch
+		done[w.index] = w
+		if w.skipped {
+			continue
+		}
+		all = append(all, w.responses...)
+		outcome := terminal.ColorizeBold("done", 32)
+		if HasErrors(w.responses) {
+			outcome = terminal.ColorizeBold("failed", 31)
+		}
+		fmt.Fprintln(bcr_utils.Out, "["+strconv.Itoa(finished+1)+"/"+strconv.Itoa(len(dbs))+"] '"+terminal.ColorizeBold(w.result.Name, 36)+"' "+outcome)
+	}
+	close(ch)
+	var results []DatabaseResult
+	for i := 0; i < len(done); i++ {
+		if !done[i].skipped {
+			results = append(results, done[i].result)
+		}
+	}
+	return results, all
+}
+
+type RequestResult struct {
+	Request string `json:"request"`
+	Source  string `json:"source,omitempty"`
+	Target  string `json:"target"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Phase   string `json:"phase,omitempty"`
+}
+
+type ReplicationCounts struct {
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+	Existing int `json:"already_existed"`
+	Failed   int `json:"failed"`
+}
+
+type DatabaseResult struct {
+	Name         string            `json:"name"`
+	Permissions  []RequestResult   `json:"permissions"`
+	Replications []RequestResult   `json:"replications"`
+	Counts       ReplicationCounts `json:"counts"`
+}
+
+/*
+*	What happened to the _replicator database of one account:
+*	"created", "already exists" or "failed"
+ */
+type ReplicatorResult struct {
+	Account string `json:"account"`
+	Outcome string `json:"outcome"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+/*
+*	Everything a sync did, per account and per database, and whether
+*	all of it succeeded. Sessions holds the logouts, which are up to
+*	whoever ends the sessions to add.
+ */
+type Report struct {
+	Replicators []ReplicatorResult
+	Databases   []DatabaseResult
+	Sessions    []RequestResult
+	Success     bool
+}
+
+func HasErrors(responses []bcr_utils.HttpResponse) bool {
+	for i := 0; i < len(responses); i++ {
+		if responses[i].Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Converts the responses of one step into their JSON representation,
+*	leaving out the placeholders sent for requests that were never made.
+ */
+func ToRequestResults(responses []bcr_utils.HttpResponse) []RequestResult {
+	results := []RequestResult{}
+	for i := 0; i < len(responses); i++ {
+		r := responses[i]
+		if r.Endpoint == "" {
+			continue
+		}
+		result := RequestResult{Request: r.RequestType, Source: r.Source, Target: r.Endpoint, Status: r.Status}
+		if r.Err != nil {
+			result.Error = terminal.Decolorize(r.Err.Error())
+			result.Reason = bcr_utils.ErrorReason(r.Body)
+			if syncErr, ok := r.Err.(*bcr_utils.SyncError); ok {
+				result.Phase = syncErr.Phase
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+/*
+*	Sends all necessary requests to link all databases. These
+*	requests should generate documents in the target's
+*	_replicator database. Targets listed in unavailable, whose
+*	_replicator database could not be created, are skipped. Each
+*	document holds one of docSlots while it is being created.
+ */
+func createReplicationDocuments(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, unavailable []string, docSlots chan struct{}, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	replicationType := "continuous"
+	if flags.Once {
+		replicationType = "one-time"
+	} else if flags.PushOnce || flags.PullOnce {
+		replicationType = "continuous and one-time"
+	}
+	fmt.Fprintln(progressOut(flags), "\nCreating "+replicationType+" replication documents for '"+terminal.ColorizeBold(db, 36)+"'\n")
+	// buffered so that senders never block once the collector has given up
+	responses := make(chan bcr_utils.HttpResponse, len(cloudantAccounts)*len(cloudantAccounts))
+	var wg sync.WaitGroup
+	numCalls := 0
+	for i := 0; i < len(cloudantAccounts); i++ {
+		account := cloudantAccounts[i]
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if i != j && Replicates(cloudantAccounts[j], account, flags) {
+				numCalls += 1
+				wg.Add(1)
+				go func(httpClient bcr_utils.Doer, target cam.CloudantAccount, source cam.CloudantAccount, db string) {
+					defer wg.Done()
+					defer bcr_utils.RecoverResponse(responses, bcr_utils.HttpResponse{RequestType: "POST", Endpoint: target.Endpoint,
+						Source: source.Endpoint, Id: ReplicationId(source, target, db, flags)})
+					if bcr_utils.IsValid(target.Endpoint, unavailable) {
+						responses <- bcr_utils.HttpResponse{Id: ReplicationId(source, target, db, flags)}
+						return
+					}
+					select {
+					case docSlots <- struct{}{}:
+					case <-bcr_utils.Ctx.Done():
+						responses <- bcr_utils.HttpResponse{RequestType: "POST", Err: bcr_utils.Ctx.Err(), Id: ReplicationId(source, target, db, flags)}
+						return
+					}
+					defer func() { <-docSlots }()
+					r := createReplicationDocument(db, httpClient, target, source, flags)
+					if r.RequestType != "" {
+						r.Endpoint, r.Source = target.Endpoint, source.Endpoint
+					}
+					r.Id = ReplicationId(source, target, db, flags)
+					bcr_utils.Emit("replication_"+strings.Replace(replicationOutcome(r), " ", "_", -1),
+						map[string]interface{}{"db": db, "source": source.Endpoint, "target": target.Endpoint})
+					responses <- r
+				}(httpClient, account, cloudantAccounts[j], db)
+			}
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(responses)
+	}()
+	describe := describeReplication
+	if flags.ParallelDbs {
+		describe = nil
+	}
+	return bcr_utils.CheckHttpResponsesWithProgress(responses, numCalls, describe)
+}
+
+/*
+*	Reports whether source replicates into target: with --source-region
+*	only the source region pushes out to every other one, with
+*	--topology hub every replication starts or ends at the hub, and
+*	in a mesh every pair replicates. Targets grant their sources
+*	access to their databases.
+ */
+func Replicates(source cam.CloudantAccount, target cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	if source.Endpoint == target.Endpoint {
+		return false
+	}
+	if flags.SourceRegion != "" {
+		return InRegion(source, flags.SourceRegion)
+	}
+	if flags.Topology == "hub" {
+		return InRegion(source, flags.Hub) || InRegion(target, flags.Hub)
+	}
+	return true
+}
+
+/*
+*	Returns flags with --filter and --once replaced by their push or
+*	pull counterparts for a replication out of source. With --topology
+*	hub, replications out of the hub push and all others pull; the
+*	shared flags apply to a direction without its own.
+ */
+func directionFlags(source cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.Flags {
+	if flags.Topology != "hub" {
+		return flags
+	}
+	if InRegion(source, flags.Hub) {
+		if flags.PushFilter != "" {
+			flags.Filter = flags.PushFilter
+		}
+		flags.Once = flags.Once || flags.PushOnce
+	} else {
+		if flags.PullFilter != "" {
+			flags.Filter = flags.PullFilter
+		}
+		flags.Once = flags.Once || flags.PullOnce
+	}
+	return flags
+}
+
+/*
+*	Reports whether account is in region, given as a region identifier
+*	or, for cloudant-replicate-accounts, the account's name
+ */
+func InRegion(account cam.CloudantAccount, region string) bool {
+	return region == account.Endpoint || region == bcr_utils.GetRegion(account.Endpoint)
+}
+
+func describeReplication(r bcr_utils.HttpResponse) string {
+	return replicationOutcome(r) + " " + r.Id
+}
+
+/*
+*	Classifies the response for one replication document as failed,
+*	skipped, created, updated, or unchanged and already exists, which
+*	both mean the document was there already.
+ */
+func replicationOutcome(r bcr_utils.HttpResponse) string {
+	switch {
+	case r.Err != nil:
+		return "failed"
+	case r.RequestType == "":
+		return "skipped"
+	case r.RequestType == "GET":
+		return "unchanged"
+	case r.RequestType == "PUT":
+		return "updated"
+	case strings.HasPrefix(r.Status, "409"):
+		return "already exists"
+	}
+	return "created"
+}
+
+/*
+*	Counts the replication documents of one database by outcome
+ */
+func countReplications(responses []bcr_utils.HttpResponse) ReplicationCounts {
+	var counts ReplicationCounts
+	for i := 0; i < len(responses); i++ {
+		switch replicationOutcome(responses[i]) {
+		case "created":
+			counts.Created += 1
+		case "updated":
+			counts.Updated += 1
+		case "unchanged", "already exists":
+			counts.Existing += 1
+		case "failed":
+			counts.Failed += 1
+		}
+	}
+	return counts
+}
+
+/*
+*	Creates the document in target's _replicator database that
+*	replicates db from source. Nothing is sent unless db exists
+*	in both accounts, and an existing document is only replaced
+*	when its settings differ from the requested ones. It is an error
+*	if the databases of either account can't be listed.
+ */
+func createReplicationDocument(db string, httpClient bcr_utils.Doer, target cam.CloudantAccount, source cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.HttpResponse {
+	flags = directionFlags(source, flags)
+	url := bcr_utils.GetApiUrl(target) + "/" + bcr_utils.DatabasePath(flags.ReplicatorDb)
+	source_dbs, err := bcr_utils.ListDatabases(httpClient, source)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
+	target_dbs, err := bcr_utils.ListDatabases(httpClient, target)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
+	// in a dry run --create has not actually created the database
+	source_db, target_db := AccountDatabase(db, source, flags), AccountDatabase(db, target, flags)
+	if !(flags.DryRun && flags.Create) && !(bcr_utils.IsValid(source_db, source_dbs) && bcr_utils.IsValid(target_db, target_dbs)) {
+		return bcr_utils.HttpResponse{}
+	}
+	rep := make(map[string]interface{})
+	rep["_id"] = ReplicationId(source, target, db, flags)
+	rep["source"] = replicationEndpoint(source, source_db)
+	rep["target"] = replicationEndpoint(target, target_db)
+	rep["create_target"] = false
+	rep["continuous"] = !flags.Once
+	// the flags below take precedence over the same fields given as options
+	for key, value := range flags.ReplicatorOptions {
+		rep[key] = value
+	}
+	if flags.WorkerProcesses > 0 {
+		rep["worker_processes"] = flags.WorkerProcesses
+	}
+	if flags.ConnectionTimeout > 0 {
+		rep["connection_timeout"] = flags.ConnectionTimeout
+	}
+	if flags.NoCheckpoints {
+		rep["use_checkpoints"] = false
+	}
+	if flags.NoDdocs {
+		rep["selector"] = map[string]interface{}{"_id": map[string]interface{}{"$not": map[string]string{"$regex": "^_design/"}}}
+	}
+	if flags.SinceSeq != "" {
+		rep["since_seq"] = flags.SinceSeq
+	}
+	if flags.Filter != "" {
+		rep["filter"] = flags.Filter
+		if flags.QueryParams != nil {
+			rep["query_params"] = flags.QueryParams
+		}
+	}
+	// for auditing only: the replicator ignores fields it does not know
+	if flags.Owner != "" {
+		rep["x_created_by"] = flags.Owner
+	}
+	rep["x_created_at"] = now().UTC().Format(time.RFC3339)
+	bd, _ := json.Marshal(rep)
+	body := string(bd)
+	if flags.DryRun {
+		bcr_utils.PrintRequest("POST", url, body)
+		return bcr_utils.HttpResponse{}
+	}
+	existing, r := getReplicationDocument(bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), rep["_id"].(string)), db, httpClient, target, flags)
+	if r.Err == nil && existing == nil {
+		// keep using a document created under the old _id scheme
+		legacy, legacyResponse := getReplicationDocument(bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), LegacyReplicationId(source, db)), db,
+			httpClient, target, flags)
+		if legacyResponse.Err == nil && legacy != nil {
+			existing, r = legacy, legacyResponse
+			rep["_id"] = LegacyReplicationId(source, db)
+		}
+	}
+	if r.Err != nil {
+		return r
+	}
+	rType := "POST"
+	if existing != nil {
+		if !replicationChanged(existing, rep, flags) {
+			return r
+		}
+		// replace the outdated document rather than leaving it in place
+		rType = "PUT"
+		url = bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), rep["_id"].(string))
+		rep["_rev"] = existing["_rev"]
+		bd, _ = json.Marshal(rep)
+		body = string(bd)
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, rType, url, body, headers, target, flags.MaxRetries)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: rType, Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 409 && resp.StatusCode != 201 && resp.StatusCode != 202 {
+		return bcr_utils.HttpResponse{RequestType: rType, Status: resp.Status, Body: string(respBody),
+			Err: &bcr_utils.SyncError{Phase: bcr_utils.PhaseReplication, Account: target.Endpoint, Database: db, Status: resp.Status,
+				Message: "Trouble creating " + rep["_id"].(string) + " for '" + target.Endpoint + "'"}}
+	}
+	return bcr_utils.HttpResponse{RequestType: rType, Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Returns the _id of the document replicating db from source to
+*	target: the --id-prefix, if any, then the source and target regions
+*	and db, joined by underscores, which regions never contain.
+ */
+func ReplicationId(source cam.CloudantAccount, target cam.CloudantAccount, db string, flags bcr_utils.Flags) string {
+	id := bcr_utils.GetRegion(source.Endpoint) + "_" + bcr_utils.GetRegion(target.Endpoint) + "_" + db
+	if flags.IdPrefix != "" {
+		id = flags.IdPrefix + "_" + id
+	}
+	return id
+}
+
+/*
+*	The _id earlier versions gave replication documents. Documents
+*	that still use it are recognized so that they are not duplicated.
+ */
+func LegacyReplicationId(source cam.CloudantAccount, db string) string {
+	return source.Username + "-" + db
+}
+
+/*
+*	Fetches the replication document at url. The document is nil if
+*	it does not exist yet.
+ */
+func getReplicationDocument(url string, db string, httpClient bcr_utils.Doer, target cam.CloudantAccount, flags bcr_utils.Flags) (map[string]interface{}, bcr_utils.HttpResponse) {
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", url, "", nil, target, flags.MaxRetries)
+	if err != nil {
+		return nil, bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	r := bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody)}
+	if resp.StatusCode == 404 {
+		return nil, r
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(respBody, &doc)
+	if resp.StatusCode != 200 || doc["_rev"] == nil {
+		r.Err = &bcr_utils.SyncError{Phase: bcr_utils.PhaseReplication, Account: target.Endpoint, Database: db, Status: resp.Status,
+			Message: "Trouble looking up " + url[strings.LastIndex(url, "/")+1:] + " for '" + target.Endpoint + "'"}
+		return nil, r
+	}
+	return doc, r
+}
+
+/*
+*	Fields of a replication document that createReplicationDocument sets
+ */
+var replicationFields = []string{"source", "target", "create_target", "continuous", "worker_processes",
+	"connection_timeout", "filter", "query_params", "use_checkpoints", "since_seq", "selector"}
+
+/*
+*	Reports whether existing differs from the desired replication
+*	document rep in any of the fields this plugin manages, or those
+*	set with --replicator-option. The replicator's own bookkeeping
+*	fields are ignored.
+ */
+func replicationChanged(existing map[string]interface{}, rep map[string]interface{}, flags bcr_utils.Flags) bool {
+	// round trip rep so both sides hold the types json.Unmarshal produces
+	var desired map[string]interface{}
+	bd, _ := json.Marshal(rep)
+	json.Unmarshal(bd, &desired)
+	for i := 0; i < len(replicationFields); i++ {
+		if !reflect.DeepEqual(existing[replicationFields[i]], desired[replicationFields[i]]) {
+			return true
+		}
+	}
+	for key := range flags.ReplicatorOptions {
+		if !reflect.DeepEqual(existing[key], desired[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Returns the name account is granted access to other databases
+*	under: the one given for its region (or, for
+*	cloudant-replicate-accounts, its name) with --grant-as, its
+*	username otherwise.
+ */
+func Grantee(account cam.CloudantAccount, flags bcr_utils.Flags) string {
+	if name, ok := flags.GrantAs[account.Endpoint]; ok {
+		return name
+	}
+	if name, ok := flags.GrantAs[bcr_utils.GetRegion(account.Endpoint)]; ok {
+		return name
+	}
+	return account.Username
+}
+
+/*
+*	Returns the name db has in account: the one given for the account's
+*	region (or, for cloudant-replicate-accounts, its name) with --db-map,
+*	db itself otherwise. System databases are never renamed.
+ */
+func AccountDatabase(db string, account cam.CloudantAccount, flags bcr_utils.Flags) string {
+	if strings.HasPrefix(db, "_") || db == flags.ReplicatorDb {
+		return db
+	}
+	if name, ok := flags.DbMap[account.Endpoint]; ok {
+		return name
+	}
+	if name, ok := flags.DbMap[bcr_utils.GetRegion(account.Endpoint)]; ok {
+		return name
+	}
+	return db
+}
+
+/*
+*	Describes db in account as a replication source or target. IAM
+*	accounts pass their API key so the replicator can authenticate.
+ */
+func replicationEndpoint(account cam.CloudantAccount, db string) interface{} {
+	if account.ApiKey == "" {
+		return bcr_utils.CredentialsUrl(account, db)
+	}
+	return map[string]interface{}{
+		"url":  bcr_utils.GetApiUrl(account) + "/" + db,
+		"auth": map[string]interface{}{"iam": map[string]string{"api_key": account.ApiKey}},
+	}
+}
+
+/*
+*	Replications whose filter is missing on the source end up in an
+*	error state, so warn about every source lacking the filter.
+ */
+func checkFilter(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		account := cloudantAccounts[i]
+		// the filter runs on the source, so it is the one of replications out of account
+		filter := directionFlags(account, flags).Filter
+		if filter == "" {
+			continue
+		}
+		ddoc, name := strings.Split(filter, "/")[0], strings.Split(filter, "/")[1]
+		url := bcr_utils.GetApiUrl(account) + "/" + AccountDatabase(db, account, flags) + "/_design/" + ddoc
+		resp, err := bcr_utils.MakeRequest(httpClient, "GET", url, "", bcr_utils.AuthHeaders(account, nil))
+		if err != nil {
+			continue
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		var design struct {
+			Filters map[string]interface{} `json:"filters"`
+		}
+		json.Unmarshal(respBody, &design)
+		if resp.StatusCode == 404 || (resp.StatusCode == 200 && design.Filters[name] == nil) {
+			fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" filter '"+terminal.ColorizeBold(filter, 36)+
+				"' does not exist on '"+db+"' in '"+terminal.ColorizeBold(account.Endpoint, 36)+
+				"'. Replications from this region will fail until it is created.")
+		}
+	}
+}
+
+func createDatabase(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	fmt.Fprintln(progressOut(flags), "\nVerifying existence of '"+terminal.ColorizeBold(db, 36)+"' database for all regions")
+	responses := make(chan bcr_utils.HttpResponse)
+	slots := accountSlots(cloudantAccounts, flags)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			url := bcr_utils.GetApiUrl(account) + "/" + bcr_utils.DatabasePath(AccountDatabase(db, account, flags))
+			if flags.DryRun {
+				bcr_utils.PrintRequest("PUT", url, "")
+				responses <- bcr_utils.HttpResponse{}
+				return
+			}
+			headers := map[string]string{"Content-Type": "application/json"}
+			resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "PUT", url, "", headers, account, 0)
+			if err != nil {
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Err: err, Endpoint: account.Endpoint}
+				return
+			}
+			defer resp.Body.Close()
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode == 201 || resp.StatusCode == 202 {
+				fmt.Fprintln(progressOut(flags), "Created '"+terminal.ColorizeBold(db, 36)+"' in '"+terminal.ColorizeBold(account.Endpoint, 36)+"'")
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err, Endpoint: account.Endpoint}
+			} else if resp.StatusCode == 412 {
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err, Endpoint: account.Endpoint}
+			} else {
+				err := &bcr_utils.SyncError{Phase: bcr_utils.PhaseCreateDatabase, Account: account.Endpoint, Database: db, Status: resp.Status,
+					Message: "Problem creating '" + terminal.ColorizeBold(db, 36) + "' in '" + terminal.ColorizeBold(account.Endpoint, 36) + "'"}
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err, Endpoint: account.Endpoint}
+			}
+		}(db, httpClient, cloudantAccounts[i])
+	}
+	results := bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts))
+	close(responses)
+	return results
+}
+
+/*
+*	Reads the _security document of db in account from Cloudant's
+*	_api/v2 endpoint or, where that does not exist as on plain CouchDB
+*	and some Cloudant Local installs, from the standard one. Also
+*	returns the url it was read from, which is where changes to it
+*	have to be written. When neither has it, e.g. because db does not
+*	exist, the answer of _api/v2 is returned.
+ */
+func GetPermissions(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, maxRetries int) (bcr_utils.HttpResponse, string) {
+	url := bcr_utils.GetApiUrl(account) + "/_api/v2/db/" + bcr_utils.DatabasePath(db) + "/_security"
+	r := getSecurity(url, httpClient, account, maxRetries)
+	if r.Err == nil && strings.HasPrefix(r.Status, "404") {
+		couchUrl := bcr_utils.GetApiUrl(account) + "/" + bcr_utils.DatabasePath(db) + "/_security"
+		if couch := getSecurity(couchUrl, httpClient, account, maxRetries); couch.Err == nil && strings.HasPrefix(couch.Status, "200") {
+			return couch, couchUrl
+		}
+	}
+	return r, url
+}
+
+/*
+*	Returns the roles that CouchDB membership, which lets a user read,
+*	write and replicate a database, does not stand for
+ */
+func unexpressedRoles(roles []string) []string {
+	var unexpressed []string
+	for i := 0; i < len(roles); i++ {
+		if !bcr_utils.IsValid(roles[i], []string{"_reader", "_writer", "_replicator"}) {
+			unexpressed = append(unexpressed, roles[i])
+		}
+	}
+	return unexpressed
+}
+
+/*
+*	Tells whether the _security document at url is a plain CouchDB
+*	one, which has no cloudant section and grants access through its
+*	members instead
+ */
+func IsCouchSecurity(url string) bool {
+	return !strings.Contains(url, "/_api/v2/")
+}
+
+/*
+*	Reports whether name is one of the member names of the CouchDB
+*	_security document parsed
+ */
+func IsMember(parsed map[string]interface{}, name string) bool {
+	members, _ := parsed["members"].(map[string]interface{})
+	names, _ := members["names"].([]interface{})
+	for i := 0; i < len(names); i++ {
+		if member, _ := names[i].(string); member == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getSecurity(url string, httpClient bcr_utils.Doer, account cam.CloudantAccount, maxRetries int) bcr_utils.HttpResponse {
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", url, "", nil, account, maxRetries)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Grants the --grant-roles, _reader and _replicator by default, to
+*	every other account in the cloudant section of the _security
+*	document perms, read from url. Only that section is touched: other
+*	top-level keys such as members, admins or couchdb_auth_only, and
+*	the existing roles of every username, are written back unchanged,
+*	and roles already granted are not added twice. A plain CouchDB
+*	document has no roles per username, so there the accounts are
+*	added to the members instead, which also lets them write. That is
+*	warned about, and --grant-roles that membership can't stand for
+*	are an error. Admins are left alone, and nothing is sent when
+*	nothing has to be added.
+ */
+func modifyPermissions(perms string, url string, db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.HttpResponse {
+	var parsed map[string]interface{}
+	json.Unmarshal([]byte(perms), &parsed)
+	if parsed == nil {
+		parsed = make(map[string]interface{})
+	}
+	temp_parsed, _ := parsed["cloudant"].(map[string]interface{})
+	if temp_parsed == nil {
+		temp_parsed = make(map[string]interface{})
+	}
+	if IsCouchSecurity(url) {
+		if roles := unexpressedRoles(flags.GrantRoles); len(roles) > 0 {
+			return bcr_utils.HttpResponse{RequestType: "PUT", Err: &bcr_utils.SyncError{Phase: bcr_utils.PhasePermissions, Account: account.Endpoint,
+				Database: db, Message: "'" + db + "' in '" + terminal.ColorizeBold(account.Endpoint, 36) + "' only has a CouchDB _security document, " +
+					"which can't grant " + strings.Join(roles, ", ")}}
+		}
+	}
+	changed := false
+	for i := 0; i < len(cloudantAccounts); i++ {
+		name := Grantee(cloudantAccounts[i], flags)
+		if Grantee(account, flags) != name && Replicates(cloudantAccounts[i], account, flags) {
+			currPerms, _ := temp_parsed[name].([]interface{})
+			if IsAdmin(parsed, currPerms, name) {
+				fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" '"+terminal.ColorizeBold(name, 36)+"' is already an admin of '"+
+					db+"' in '"+terminal.ColorizeBold(account.Endpoint, 36)+"', so it is not granted "+strings.Join(flags.GrantRoles, ", ")+". "+
+					"Check that it is meant to be.")
+				continue
+			}
+			if IsCouchSecurity(url) {
+				if !IsMember(parsed, name) {
+					members, _ := parsed["members"].(map[string]interface{})
+					if members == nil {
+						members = make(map[string]interface{})
+					}
+					names, _ := members["names"].([]interface{})
+					members["names"] = append(names, name)
+					parsed["members"] = members
+					changed = true
+				}
+				continue
+			}
+			merged := AddRoles(currPerms, flags.GrantRoles...)
+			changed = changed || len(merged) != len(currPerms)
+			temp_parsed[name] = merged
+		}
+	}
+	if !changed {
+		fmt.Fprintln(progressOut(flags), "Permissions of '"+db+"' in '"+terminal.ColorizeBold(account.Endpoint, 36)+"' are already in place")
+		return bcr_utils.HttpResponse{}
+	}
+	if IsCouchSecurity(url) && !bcr_utils.IsValid("_writer", flags.GrantRoles) {
+		fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" '"+db+"' in '"+terminal.ColorizeBold(account.Endpoint, 36)+
+			"' only has a CouchDB _security document, so the other accounts are made members, which can write to it as well")
+	}
+	if !IsCouchSecurity(url) {
+		parsed["cloudant"] = temp_parsed
+	}
+	bd, _ := json.MarshalIndent(parsed, "", "  ")
+	body := string(bd)
+	if flags.DryRun {
+		bcr_utils.PrintRequest("PUT", url, body)
+		return bcr_utils.HttpResponse{}
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "PUT", url, body, headers, account, flags.MaxRetries)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		err = &bcr_utils.SyncError{Phase: bcr_utils.PhasePermissions, Account: account.Endpoint, Database: db, Status: resp.Status,
+			Message: "Permissions PUT request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) + "'"}
+	}
+	return bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Reports whether name already has admin access to the database whose
+*	_security document is parsed, through the _admin role in the cloudant
+*	section (whose roles for name are currPerms) or the admins names
+ */
+func IsAdmin(parsed map[string]interface{}, currPerms []interface{}, name string) bool {
+	for i := 0; i < len(currPerms); i++ {
+		if role, _ := currPerms[i].(string); role == "_admin" {
+			return true
+		}
+	}
+	admins, _ := parsed["admins"].(map[string]interface{})
+	names, _ := admins["names"].([]interface{})
+	for i := 0; i < len(names); i++ {
+		if admin, _ := names[i].(string); admin == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Appends the roles that are not in currPerms yet, keeping
+*	the existing roles and their order.
+ */
+func AddRoles(currPerms []interface{}, roles ...string) []interface{} {
+	merged := append([]interface{}{}, currPerms...)
+	for i := 0; i < len(roles); i++ {
+		found := false
+		for j := 0; j < len(merged); j++ {
+			if role, _ := merged[j].(string); role == roles[i] {
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, roles[i])
+		}
+	}
+	return merged
+}
+
+/*
+*	Retrieves the current permissions for each database that is to be
+*	replicated and modifies those permissions to allow read and replicate
+*	permissions for every other database
+ */
+func shareDatabases(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	fmt.Fprintln(progressOut(flags), "\nModifying database permissions for '"+terminal.ColorizeBold(db, 36)+"'\n")
+	responses := make(chan bcr_utils.HttpResponse, len(cloudantAccounts)*2)
+	var wg sync.WaitGroup
+	for i := 0; i < len(cloudantAccounts); i++ {
+		wg.Add(1)
+		go func(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) {
+			defer wg.Done()
+			defer bcr_utils.RecoverResponse(responses, bcr_utils.HttpResponse{RequestType: "PUT", Endpoint: account.Endpoint})
+			r, url := GetPermissions(AccountDatabase(db, account, flags), httpClient, account, flags.MaxRetries)
+			r.Endpoint = account.Endpoint
+			split_status := strings.Split(r.Status, " ")[0]
+			status, _ := strconv.Atoi(split_status)
+			if status <= 200 && r.Err == nil {
+				responses <- r
+				modified := modifyPermissions(r.Body, url, AccountDatabase(db, account, flags), httpClient, account, cloudantAccounts, flags)
+				outcome := "permissions_unchanged"
+				if modified.RequestType != "" {
+					modified.Endpoint = account.Endpoint
+					outcome = "permissions_granted"
+				}
+				if modified.Err != nil {
+					outcome = "permissions_failed"
+				}
+				bcr_utils.Emit(outcome, map[string]interface{}{"db": db, "target": account.Endpoint})
+				responses <- modified
+			} else {
+				r.Err = &bcr_utils.SyncError{Phase: bcr_utils.PhasePermissions, Account: account.Endpoint, Database: db, Status: r.Status,
+					Message: "Permissions GET request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) +
+						"'\nUse the '" + terminal.ColorizeBold("--create", 33) + "' argument to create non-existing databases"}
+				bcr_utils.Emit("permissions_failed", map[string]interface{}{"db": db, "target": account.Endpoint})
+				responses <- r
+				responses <- bcr_utils.HttpResponse{}
+			}
+		}(db, httpClient, cloudantAccounts[i], cloudantAccounts)
+	}
+	go func() {
+		wg.Wait()
+		close(responses)
+	}()
+	return bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*2)
+}
+
+const cookieJitter = 250 * time.Millisecond
+
+/*
+*	Returns the semaphore of the steps that send a request to every
+*	account, creating databases and deleting cookies: it holds
+*	--parallel-accounts slots, or one per account by default
+ */
+func accountSlots(cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) chan struct{} {
+	n := flags.ParallelAccounts
+	if n < 1 || n > len(cloudantAccounts) {
+		n = len(cloudantAccounts)
+	}
+	return make(chan struct{}, n)
+}
+
+/*
+*	Deletes the cookies that were used to authenticate the api calls
+ */
+func DeleteCookies(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, opts Options) []bcr_utils.HttpResponse {
+	flags := opts.flags()
+	fmt.Fprint(bcr_utils.Out, "\nDeleting Cookies\n\n")
+	responses := make(chan bcr_utils.HttpResponse)
+	slots := accountSlots(cloudantAccounts, flags)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(httpClient bcr_utils.Doer, account cam.CloudantAccount) {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			// IAM tokens are not sessions and cannot be deleted
+			if account.Token != "" {
+				responses <- bcr_utils.HttpResponse{}
+				return
+			}
+			// spread the requests out rather than hitting every account at once
+			time.Sleep(time.Duration(rand.Int63n(int64(cookieJitter))))
+			url := bcr_utils.GetApiUrl(account) + "/_session"
+			headers := bcr_utils.AuthHeaders(account, nil)
+			r, err := bcr_utils.MakeCleanupRequest(httpClient, "DELETE", url, "", headers)
+			if err != nil {
+				responses <- bcr_utils.HttpResponse{RequestType: "DELETE", Err: err, Endpoint: account.Endpoint}
+				return
+			}
+			defer r.Body.Close()
+			if r.StatusCode != 200 {
+				err = errors.New("Failed to delete cookie for '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
+			}
+			respBody, _ := ioutil.ReadAll(r.Body)
+			responses <- bcr_utils.HttpResponse{RequestType: "DELETE", Status: r.Status, Body: string(respBody), Err: err, Endpoint: account.Endpoint}
+		}(httpClient, cloudantAccounts[i])
+	}
+	results := bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts))
+	close(responses)
+	return results
+}
+
+/*
+*	Counts the replications createReplicationDocuments sets up for a
+*	database, for databases whose replications are already in place
+ */
+func countLinks(cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) int {
+	links := 0
+	for i := 0; i < len(cloudantAccounts); i++ {
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if Replicates(cloudantAccounts[j], cloudantAccounts[i], flags) {
+				links += 1
+			}
+		}
+	}
+	return links
+}
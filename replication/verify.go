@@ -0,0 +1,100 @@
+package bcr_replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// how long --verify waits for the canary to reach every other account
+const verifyTimeout = 2 * time.Minute
+
+/*
+*	Checks that data actually flows for db by writing a canary document
+*	to the first account (or the --source-region or --hub one) and
+*	waiting for it to show up in every other account, reporting how
+*	long it took to arrive in each. The canary is deleted again
+*	afterwards. It is an error if no account is in the origin region.
+ */
+func verifyReplication(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	// the canary has to start where every replication can pick it up
+	origin := flags.SourceRegion
+	if origin == "" {
+		origin = flags.Hub
+	}
+	var source cam.CloudantAccount
+	var targets []cam.CloudantAccount
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if source.Endpoint == "" && (origin == "" || InRegion(cloudantAccounts[i], origin)) {
+			source = cloudantAccounts[i]
+		} else {
+			targets = append(targets, cloudantAccounts[i])
+		}
+	}
+	if source.Endpoint == "" {
+		return []bcr_utils.HttpResponse{bcr_utils.HttpResponse{RequestType: "PUT", Err: &bcr_utils.SyncError{Phase: bcr_utils.PhaseVerify,
+			Database: db, Message: "No account is in region '" + terminal.ColorizeBold(origin, 36) + "' to write the canary document to"}}}
+	}
+	id := "bcr-canary-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	fmt.Fprintln(progressOut(flags), "\nVerifying replication of '"+terminal.ColorizeBold(db, 36)+"' from '"+
+		terminal.ColorizeBold(source.Endpoint, 36)+"'\n")
+	url := bcr_utils.DocumentUrl(source, AccountDatabase(db, source, flags), id)
+	bd, _ := json.Marshal(map[string]interface{}{"bcr_canary": true, "created": time.Now().UTC().Format(time.RFC3339)})
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "PUT", url, string(bd), headers, source, flags.MaxRetries)
+	if err != nil {
+		return []bcr_utils.HttpResponse{bcr_utils.HttpResponse{RequestType: "PUT", Err: err, Endpoint: source.Endpoint}}
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 201 && resp.StatusCode != 202 {
+		return []bcr_utils.HttpResponse{bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody),
+			Endpoint: source.Endpoint, Err: &bcr_utils.SyncError{Phase: bcr_utils.PhaseVerify, Account: source.Endpoint, Database: db,
+				Status: resp.Status, Message: "Unable to write the canary document to '" + terminal.ColorizeBold(source.Endpoint, 36) + "'"}}}
+	}
+	written := time.Now()
+	responses := make(chan bcr_utils.HttpResponse)
+	for i := 0; i < len(targets); i++ {
+		go func(target cam.CloudantAccount) {
+			responses <- waitForCanary(db, id, written, httpClient, source, target, flags)
+		}(targets[i])
+	}
+	results := bcr_utils.CheckHttpResponses(responses, len(targets))
+	close(responses)
+	if r := bcr_utils.DeleteDocument(url, httpClient, source, flags.MaxRetries); r.Err != nil {
+		fmt.Fprintln(bcr_utils.Errors, terminal.ColorizeBold("WARNING", 33)+" unable to delete the canary document '"+id+
+			"' from '"+terminal.ColorizeBold(source.Endpoint, 36)+"'")
+	}
+	return results
+}
+
+/*
+*	Polls target until the canary document id arrives or verifyTimeout
+*	passes, printing how long it took to replicate.
+ */
+func waitForCanary(db string, id string, written time.Time, httpClient bcr_utils.Doer, source cam.CloudantAccount, target cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.HttpResponse {
+	url := bcr_utils.DocumentUrl(target, AccountDatabase(db, target, flags), id)
+	status := ""
+	for time.Since(written) < verifyTimeout && bcr_utils.Ctx.Err() == nil {
+		resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", url, "", nil, target, flags.MaxRetries)
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			status = resp.Status
+			if resp.StatusCode == 200 {
+				fmt.Fprintln(progressOut(flags), "Canary reached '"+terminal.ColorizeBold(target.Endpoint, 36)+"' after "+
+					time.Since(written).Round(100*time.Millisecond).String())
+				return bcr_utils.HttpResponse{RequestType: "GET", Status: status, Endpoint: target.Endpoint, Source: source.Endpoint}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return bcr_utils.HttpResponse{RequestType: "GET", Status: status, Endpoint: target.Endpoint, Source: source.Endpoint,
+		Err: &bcr_utils.SyncError{Phase: bcr_utils.PhaseVerify, Account: target.Endpoint, Database: db, Status: status,
+			Message: "The canary document did not reach '" + terminal.ColorizeBold(target.Endpoint, 36) + "' within " + verifyTimeout.String()}}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"strings"
+)
+
+/*
+*	With --resume, reads the replication documents and _security
+*	documents already in place so that only what an interrupted run
+*	left undone is done again. Returns nil without --resume, which
+*	leaves every database to be worked on in full.
+ */
+func resumePlan(dbs []string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) map[string]bcr_replication.Progress {
+	if !flags.Resume {
+		return nil
+	}
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nRESUMING", 35)+"\n")
+	states := getReplicationStates(httpClient, cloudantAccounts, flags)
+	plan := make(map[string]bcr_replication.Progress)
+	for i := 0; i < len(dbs); i++ {
+		done := bcr_replication.Progress{Shared: true, Replicated: true}
+		for j := 0; j < len(cloudantAccounts); j++ {
+			for k := 0; k < len(cloudantAccounts); k++ {
+				if bcr_replication.Replicates(cloudantAccounts[k], cloudantAccounts[j], flags) {
+					state := replicationState(dbs[i], states, cloudantAccounts[k], cloudantAccounts[j], flags)
+					done.Replicated = done.Replicated && state != "missing" && state != "unknown"
+				}
+			}
+		}
+		granted := make(chan bool, len(cloudantAccounts))
+		for j := 0; j < len(cloudantAccounts); j++ {
+			go func(db string, account cam.CloudantAccount) {
+				granted <- hasGrants(db, httpClient, account, cloudantAccounts, flags)
+			}(dbs[i], cloudantAccounts[j])
+		}
+		for j := 0; j < len(cloudantAccounts); j++ {
+			done.Shared = <-granted && done.Shared
+		}
+		plan[dbs[i]] = done
+		var finished []string
+		if done.Shared {
+			finished = append(finished, "permissions")
+		}
+		if done.Replicated {
+			finished = append(finished, "replications")
+		}
+		if len(finished) > 0 {
+			fmt.Fprintln(bcr_utils.Out, "'"+terminal.ColorizeBold(dbs[i], 36)+"': "+strings.Join(finished, " and ")+" already in place")
+		}
+	}
+	return plan
+}
+
+/*
+*	Reports whether the _security document of db in account already
+*	grants the --grant-roles, or admin access, to every account
+*	replicating into it
+ */
+func hasGrants(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	r, url := bcr_replication.GetPermissions(bcr_replication.AccountDatabase(db, account, flags), httpClient, account, flags.MaxRetries)
+	if r.Err != nil || !strings.HasPrefix(r.Status, "200") {
+		return false
+	}
+	var parsed map[string]interface{}
+	json.Unmarshal([]byte(r.Body), &parsed)
+	cloudant, _ := parsed["cloudant"].(map[string]interface{})
+	for i := 0; i < len(cloudantAccounts); i++ {
+		name := bcr_replication.Grantee(cloudantAccounts[i], flags)
+		if bcr_replication.Grantee(account, flags) != name && bcr_replication.Replicates(cloudantAccounts[i], account, flags) {
+			currPerms, _ := cloudant[name].([]interface{})
+			if bcr_replication.IsCouchSecurity(url) {
+				if !bcr_replication.IsAdmin(parsed, nil, name) && !bcr_replication.IsMember(parsed, name) {
+					return false
+				}
+				continue
+			}
+			if !bcr_replication.IsAdmin(parsed, currPerms, name) && len(bcr_replication.AddRoles(currPerms, flags.GrantRoles...)) != len(currPerms) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+*	Lists the databases whose permissions still have to be granted
+ */
+func unshared(dbs []string, plan map[string]bcr_replication.Progress) []string {
+	var pending []string
+	for i := 0; i < len(dbs); i++ {
+		if !plan[dbs[i]].Shared {
+			pending = append(pending, dbs[i])
+		}
+	}
+	return pending
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"text/tabwriter"
+	"time"
+)
+
+type replicatorDocs struct {
+	username string
+	states   map[string]string
+	err      error
+}
+
+/*
+*	Reports the state of the replication documents created by
+*	cloudant-replicate for the selected databases, returning whether
+*	every replication is triggered or completed.
+ */
+func replicationStatus(cliConnection plugin.CliConnection, args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password, endpoints := setup(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := getCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+	bcr_utils.CheckErrorFatal(err)
+	dbs := selectDatabases(httpClient, cloudantAccounts, flags)
+	states := getReplicationStates(httpClient, cloudantAccounts, flags)
+	healthy := true
+	for i := 0; i < len(dbs); i++ {
+		healthy = printReplicationStates(dbs[i], states, cloudantAccounts, flags) && healthy
+	}
+	endSessions(httpClient, cloudantAccounts, flags)
+	return healthy
+}
+
+/*
+*	Reads every document in each account's _replicator database and
+*	returns their _replication_state keyed by account username and
+*	document id. Documents that have not been picked up by the
+*	replicator yet are reported as "pending".
+ */
+func getReplicationStates(httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) map[string]map[string]string {
+	states := make(map[string]map[string]string)
+	ch := make(chan replicatorDocs)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(httpClient bcr_utils.Doer, account cam.CloudantAccount) {
+			ch <- getReplicatorDocs(httpClient, account, flags)
+		}(httpClient, cloudantAccounts[i])
+	}
+	num_responses := 0
+	for {
+		select {
+		case r := <-ch:
+			num_responses += 1
+			if !bcr_utils.CheckErrorNonFatal(r.err) {
+				states[r.username] = r.states
+			}
+		case <-time.After(50 * time.Millisecond):
+			continue
+		}
+		if num_responses == len(cloudantAccounts) {
+			break
+		}
+	}
+	close(ch)
+	return states
+}
+
+func getReplicatorDocs(httpClient bcr_utils.Doer, account cam.CloudantAccount, flags bcr_utils.Flags) replicatorDocs {
+	url := bcr_utils.GetApiUrl(account) + "/" + bcr_utils.DatabasePath(flags.ReplicatorDb) + "/_all_docs?include_docs=true"
+	// the session may expire while cloudant-replication-monitor is polling
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "GET", url, "", nil, account, flags.MaxRetries)
+	if err != nil {
+		return replicatorDocs{username: account.Username, err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return replicatorDocs{username: account.Username,
+			err: fmt.Errorf("Unable to read the %s database for '%s' (%s)", flags.ReplicatorDb, account.Endpoint, resp.Status)}
+	}
+	var all_docs struct {
+		Rows []struct {
+			Id  string                 `json:"id"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	err = json.Unmarshal(respBody, &all_docs)
+	states := make(map[string]string)
+	for i := 0; i < len(all_docs.Rows); i++ {
+		state, _ := all_docs.Rows[i].Doc["_replication_state"].(string)
+		if state == "" {
+			state = "pending"
+		}
+		states[all_docs.Rows[i].Id] = state
+	}
+	return replicatorDocs{username: account.Username, states: states, err: err}
+}
+
+/*
+*	Prints a source/target/state table for one database. States other
+*	than triggered or completed are highlighted in red, and reported
+*	by returning false.
+ */
+func printReplicationStates(db string, states map[string]map[string]string, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bool {
+	fmt.Fprintln(bcr_utils.Out, "\nReplication status for '"+terminal.ColorizeBold(db, 36)+"'\n")
+	healthy := true
+	w := tabwriter.NewWriter(bcr_utils.Out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tTARGET\tSTATE")
+	for i := 0; i < len(cloudantAccounts); i++ {
+		target := cloudantAccounts[i]
+		for j := 0; j < len(cloudantAccounts); j++ {
+			source := cloudantAccounts[j]
+			if i == j || !bcr_replication.Replicates(source, target, flags) {
+				continue
+			}
+			state := replicationState(db, states, source, target, flags)
+			if !healthyState(state) {
+				healthy = false
+				state = terminal.Colorize(state, 31)
+			}
+			fmt.Fprintln(w, source.Endpoint+"\t"+target.Endpoint+"\t"+state)
+		}
+	}
+	w.Flush()
+	return healthy
+}
+
+/*
+*	Looks up the state of the replication of db from source to target,
+*	"missing" if it has no replication document and "unknown" if the
+*	target's _replicator database could not be read.
+ */
+func replicationState(db string, states map[string]map[string]string, source cam.CloudantAccount, target cam.CloudantAccount, flags bcr_utils.Flags) string {
+	targetStates, ok := states[target.Username]
+	if !ok {
+		return "unknown"
+	}
+	if s, ok := targetStates[bcr_replication.ReplicationId(source, target, db, flags)]; ok {
+		return s
+	}
+	if s, ok := targetStates[bcr_replication.LegacyReplicationId(source, db)]; ok {
+		return s
+	}
+	return "missing"
+}
+
+func healthyState(state string) bool {
+	return state == "triggered" || state == "completed"
+}
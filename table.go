@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"strings"
+)
+
+/*
+*	Prints a matrix per database of the replications from each account
+*	(rows) to each other account (columns), giving a quick view of how
+*	complete the mesh is. Without colors it sticks to plain ASCII.
+ */
+func printReplicationTable(results []bcr_replication.DatabaseResult, cloudantAccounts []cam.CloudantAccount) {
+	ok, failed, none := terminal.ColorizeBold("✓", 32), terminal.ColorizeBold("✗", 31), "-"
+	if !bcr_utils.Colors {
+		ok, failed = "ok", "x"
+	}
+	var labels []string
+	width := len("from \\ to")
+	for i := 0; i < len(cloudantAccounts); i++ {
+		labels = append(labels, bcr_utils.GetRegion(cloudantAccounts[i].Endpoint))
+		if len(labels[i]) > width {
+			width = len(labels[i])
+		}
+	}
+	width += 2
+	fmt.Fprintln(bcr_utils.Out, terminal.ColorizeBold("\nREPLICATION MATRIX", 35))
+	for i := 0; i < len(results); i++ {
+		fmt.Fprintln(bcr_utils.Out, "\n'"+terminal.ColorizeBold(results[i].Name, 36)+"'\n")
+		header := pad("from \\ to", width)
+		for j := 0; j < len(labels); j++ {
+			header += pad(labels[j], width)
+		}
+		fmt.Fprintln(bcr_utils.Out, strings.TrimRight(header, " "))
+		for j := 0; j < len(cloudantAccounts); j++ {
+			row := pad(labels[j], width)
+			for k := 0; k < len(cloudantAccounts); k++ {
+				cell := none
+				if j == k {
+					cell = ""
+				} else if r, found := findReplication(results[i].Replications, cloudantAccounts[j], cloudantAccounts[k]); found {
+					cell = ok
+					if r.Error != "" {
+						cell = failed
+					}
+				}
+				row += cell + strings.Repeat(" ", width-len([]rune(terminal.Decolorize(cell))))
+			}
+			fmt.Fprintln(bcr_utils.Out, strings.TrimRight(row, " "))
+		}
+	}
+	fmt.Fprintln(bcr_utils.Out, "\n"+ok+" replicating   "+failed+" failed   "+none+" not replicated")
+}
+
+func findReplication(replications []bcr_replication.RequestResult, source cam.CloudantAccount, target cam.CloudantAccount) (bcr_replication.RequestResult, bool) {
+	for i := 0; i < len(replications); i++ {
+		if replications[i].Source == source.Endpoint && replications[i].Target == target.Endpoint {
+			return replications[i], true
+		}
+	}
+	return bcr_replication.RequestResult{}, false
+}
+
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", width-len(s))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replication"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Tears down the replication set up by cloudant-replicate for the
+*	selected databases and, with --revoke, the permissions it granted.
+*	Returns false if any request failed along the way.
+ */
+func unreplicate(cliConnection plugin.CliConnection, args []string) bool {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password, endpoints := setup(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	httpClient := newHttpClient(flags)
+	cloudantAccounts, err := getCloudantAccounts(cliConnection, httpClient, endpoints, appname, password, flags)
+	bcr_utils.CheckErrorFatal(err)
+	checkGrantAs(cloudantAccounts, flags)
+	dbs := selectDatabases(httpClient, cloudantAccounts, flags)
+	failed := false
+	for i := 0; i < len(dbs); i++ {
+		failed = bcr_replication.HasErrors(deleteReplicationDocuments(dbs[i], httpClient, cloudantAccounts, flags)) || failed
+		if flags.Revoke {
+			failed = bcr_replication.HasErrors(unshareDatabases(dbs[i], httpClient, cloudantAccounts, flags)) || failed
+		}
+	}
+	failed = bcr_replication.HasErrors(endSessions(httpClient, cloudantAccounts, flags)) || failed
+	finalSummary(appname, endpoints, cloudantAccounts)
+	return !failed
+}
+
+/*
+*	Deletes the replication documents created by createReplicationDocuments
+*	from each target's _replicator database, under both the current and
+*	the legacy _id. Documents that are already gone are treated as deleted.
+ */
+func deleteReplicationDocuments(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	fmt.Fprintln(bcr_utils.Out, "\nDeleting replication documents for '"+terminal.ColorizeBold(db, 36)+"'\n")
+	responses := make(chan bcr_utils.HttpResponse)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		account := cloudantAccounts[i]
+		for j := 0; j < len(cloudantAccounts); j++ {
+			if i != j {
+				go func(httpClient bcr_utils.Doer, target cam.CloudantAccount, source cam.CloudantAccount, db string) {
+					r := bcr_utils.DeleteDocument(bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), bcr_replication.ReplicationId(source, target, db, flags)), httpClient, target, flags.MaxRetries)
+					if r.Err == nil {
+						r = bcr_utils.DeleteDocument(bcr_utils.DocumentUrl(target, bcr_utils.DatabasePath(flags.ReplicatorDb), bcr_replication.LegacyReplicationId(source, db)), httpClient, target, flags.MaxRetries)
+					}
+					responses <- r
+				}(httpClient, account, cloudantAccounts[j], db)
+			}
+		}
+	}
+	results := bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*(len(cloudantAccounts)-1))
+	close(responses)
+	return results
+}
+
+/*
+*	Removes the --grant-roles, _reader and _replicator by default,
+*	that modifyPermissions granted to the other accounts in the
+*	_security document perms, read from url, dropping a username
+*	entirely once it has no roles left. From a plain CouchDB document
+*	the accounts are removed as members instead. Nothing is sent when
+*	there is nothing to revoke.
+ */
+func revokePermissions(perms string, url string, db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) bcr_utils.HttpResponse {
+	var parsed map[string]interface{}
+	json.Unmarshal([]byte(perms), &parsed)
+	if parsed == nil {
+		parsed = make(map[string]interface{})
+	}
+	temp_parsed, _ := parsed["cloudant"].(map[string]interface{})
+	if temp_parsed == nil {
+		temp_parsed = make(map[string]interface{})
+	}
+	changed := false
+	for i := 0; i < len(cloudantAccounts); i++ {
+		name := bcr_replication.Grantee(cloudantAccounts[i], flags)
+		if bcr_replication.Grantee(account, flags) != name && bcr_replication.IsCouchSecurity(url) {
+			changed = removeMember(parsed, name) || changed
+		}
+		if bcr_replication.Grantee(account, flags) == name || temp_parsed[name] == nil {
+			continue
+		}
+		currPerms, _ := temp_parsed[name].([]interface{})
+		var keptPerms []interface{}
+		for j := 0; j < len(currPerms); j++ {
+			if role, _ := currPerms[j].(string); !bcr_utils.IsValid(role, flags.GrantRoles) {
+				keptPerms = append(keptPerms, currPerms[j])
+			}
+		}
+		if len(keptPerms) == len(currPerms) {
+			continue
+		}
+		changed = true
+		if len(keptPerms) == 0 {
+			delete(temp_parsed, name)
+		} else {
+			temp_parsed[name] = keptPerms
+		}
+	}
+	if !changed {
+		return bcr_utils.HttpResponse{}
+	}
+	if !bcr_replication.IsCouchSecurity(url) {
+		parsed["cloudant"] = temp_parsed
+	}
+	bd, _ := json.MarshalIndent(parsed, "", "  ")
+	body := string(bd)
+	headers := map[string]string{"Content-Type": "application/json"}
+	resp, err := bcr_utils.MakeAuthenticatedRequest(httpClient, "PUT", url, body, headers, account, flags.MaxRetries)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		err = &bcr_utils.SyncError{Phase: bcr_utils.PhasePermissions, Account: account.Endpoint, Database: db, Status: resp.Status,
+			Message: "Permissions PUT request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) + "'"}
+	}
+	return bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Drops name from the member names of the CouchDB _security
+*	document parsed, reporting whether it was one
+ */
+func removeMember(parsed map[string]interface{}, name string) bool {
+	members, _ := parsed["members"].(map[string]interface{})
+	names, _ := members["names"].([]interface{})
+	var kept []interface{}
+	for i := 0; i < len(names); i++ {
+		if member, _ := names[i].(string); member != name {
+			kept = append(kept, names[i])
+		}
+	}
+	if len(kept) == len(names) {
+		return false
+	}
+	members["names"] = kept
+	return true
+}
+
+/*
+*	Retrieves the current permissions for each database and revokes
+*	the access previously granted to every other account
+ */
+func unshareDatabases(db string, httpClient bcr_utils.Doer, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags) []bcr_utils.HttpResponse {
+	fmt.Fprintln(bcr_utils.Out, "\nRevoking database permissions for '"+terminal.ColorizeBold(db, 36)+"'\n")
+	responses := make(chan bcr_utils.HttpResponse)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(db string, httpClient bcr_utils.Doer, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) {
+			r, url := bcr_replication.GetPermissions(bcr_replication.AccountDatabase(db, account, flags), httpClient, account, flags.MaxRetries)
+			split_status := strings.Split(r.Status, " ")[0]
+			status, _ := strconv.Atoi(split_status)
+			if status == 404 && r.Err == nil {
+				responses <- bcr_utils.HttpResponse{}
+				responses <- bcr_utils.HttpResponse{}
+			} else if status <= 200 && r.Err == nil {
+				responses <- r
+				responses <- revokePermissions(r.Body, url, db, httpClient, account, cloudantAccounts, flags)
+			} else {
+				r.Err = errors.New("Permissions GET request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
+				responses <- r
+				responses <- bcr_utils.HttpResponse{}
+			}
+		}(db, httpClient, cloudantAccounts[i], cloudantAccounts)
+	}
+	results := bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*2)
+	close(responses)
+	return results
+}
@@ -2,15 +2,27 @@ package bcr_utils
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cloudfoundry/cli/cf/terminal"
 	"github.com/cloudfoundry/cli/plugin"
 	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"golang.org/x/time/rate"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,8 +31,165 @@ type HttpResponse struct {
 	Status      string
 	Body        string
 	Err         error
+	Endpoint    string
+	Source      string
+	Id          string
 }
 
+/*
+*	The phases of a sync, as recorded in SyncError
+ */
+const (
+	PhaseCreateDatabase = "create database"
+	PhasePermissions    = "permissions"
+	PhaseReplication    = "replication"
+	PhaseVerify         = "verify"
+)
+
+/*
+*	A failure in one phase of a sync, recording the account and
+*	database it concerns and the status Cloudant answered with.
+ */
+type SyncError struct {
+	Phase    string
+	Account  string
+	Database string
+	Status   string
+	Message  string
+}
+
+func (e *SyncError) Error() string {
+	return e.Message
+}
+
+/*
+*	All human-readable output goes through Out so that it can be
+*	silenced when the results are reported as JSON instead.
+ */
+var Out io.Writer = os.Stdout
+
+/*
+*	Failures and warnings go through Errors instead, so that they are
+*	still printed when --quiet silences Out.
+ */
+var Errors io.Writer = os.Stdout
+
+/*
+*	With --events, where Emit writes its events. nil means the
+*	events are off.
+ */
+var Events io.Writer
+
+// events are emitted by concurrent requests, one line at a time
+var eventsLock sync.Mutex
+
+/*
+*	When set, every request and the status of its response are logged
+*	to Out, with credentials redacted.
+ */
+var Verbose = false
+
+/*
+*	When set, long running steps report "[n/total]" progress to Out
+*	as each of their requests completes.
+ */
+var ShowProgress = true
+
+/*
+*	Whether the output is colored. Summaries that rely on color,
+*	like the replication matrix, fall back to plain ASCII without it.
+ */
+var Colors = true
+
+/*
+*	Caps the rate at which requests are sent to Cloudant, for plans
+*	with a requests per second quota. nil means unlimited.
+ */
+var Limiter *rate.Limiter
+
+/*
+*	Cancelled when the user hits Ctrl-C, aborting the requests in
+*	flight. See CancelOnInterrupt.
+ */
+var Ctx = context.Background()
+
+/*
+*	Writes event to Events as a single line of JSON, along with
+*	fields and the time, e.g. {"event":"replication_created",
+*	"db":"x","source":...,"target":...,"time":...}
+ */
+func Emit(event string, fields map[string]interface{}) {
+	if Events == nil {
+		return
+	}
+	line := map[string]interface{}{"event": event, "time": time.Now().UTC().Format(time.RFC3339)}
+	for key, value := range fields {
+		line[key] = value
+	}
+	bd, _ := json.Marshal(line)
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	Events.Write(append(bd, '\n'))
+}
+
+/*
+*	Replaces Ctx with one that is cancelled on the first Ctrl-C. A
+*	second Ctrl-C exits right away. The returned function stops
+*	listening for Ctrl-C.
+ */
+func CancelOnInterrupt() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	Ctx = ctx
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		if _, ok := <-interrupts; !ok {
+			return
+		}
+		fmt.Fprintln(Errors, terminal.ColorizeBold("\nInterrupted, cancelling the requests in flight", 33))
+		cancel()
+		if _, ok := <-interrupts; ok {
+			os.Exit(130)
+		}
+	}()
+	return func() {
+		signal.Stop(interrupts)
+		close(interrupts)
+		cancel()
+	}
+}
+
+/*
+*	Makes Ctx expire d from now, for --deadline. Requests still in
+*	flight at that point are cancelled just like on Ctrl-C.
+ */
+func SetDeadline(d time.Duration) {
+	ctx, cancel := context.WithTimeout(Ctx, d)
+	Ctx = ctx
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			fmt.Fprintln(Errors, terminal.ColorizeBold("\nThe deadline of "+d.String()+" has passed, cancelling the requests in flight", 33))
+		}
+		cancel()
+	}()
+}
+
+/*
+*	Authenticates account again once its session has expired, returning
+*	it with fresh credentials. Set by the ca package, which knows how
+*	accounts authenticate.
+ */
+var Reauthenticate func(httpClient Doer, account cam.CloudantAccount) (cam.CloudantAccount, error)
+
+var (
+	renewedLock sync.Mutex
+	// accounts whose credentials were renewed mid-run, by renewedKey
+	renewed = make(map[string]cam.CloudantAccount)
+)
+
+var redactedHeaders = []string{"Cookie", "Authorization"}
+
 func init() {
 	terminal.InitColorSupport()
 }
@@ -35,31 +204,387 @@ func GetCurrentTarget(cliConnection plugin.CliConnection) (string, string, strin
 	return endpoint, username, org, space
 }
 
+/*
+*	Sends http requests. Every request to Cloudant goes through one,
+*	which is the *http.Client made by NewHttpClient outside of tests.
+ */
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+/*
+*	Creates the http client shared by every Cloudant request. All
+*	Cloudant endpoints are TLS-only, so the client is always built
+*	around an explicit TLS config. Requests go through proxy if it is
+*	given, and through the proxy named by HTTPS_PROXY (unless NO_PROXY
+*	excludes the host) otherwise.
+ */
+func NewHttpClient(tlsConfig *tls.Config, proxy *url.URL) *http.Client {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport}
+}
+
+/*
+*	Returns the base URL of the Cloudant API for an account, taken from
+*	the scheme and host of its service credentials' url, so that an
+*	account can also point at a local server such as a test double.
+*	Every request, and every replication document, is built from this
+*	so that they all go to the same host whatever the account's username.
+*	An url that can't be parsed gives "", so that requests built on it
+*	fail rather than sending the credentials in it anywhere.
+ */
+func GetApiUrl(account cam.CloudantAccount) string {
+	apiUrl, err := ParseApiUrl(account)
+	if err != nil {
+		return ""
+	}
+	return apiUrl
+}
+
+/*
+*	Returns the base URL of the Cloudant API for an account like
+*	GetApiUrl, or an error if the account's url is not valid. The
+*	error never includes the url, which may hold credentials.
+ */
+func ParseApiUrl(account cam.CloudantAccount) (string, error) {
+	u, err := url.Parse(account.Url)
+	if err != nil || u.Host == "" {
+		return "", errors.New("The url of the Cloudant account '" + account.Username + "' is not valid")
+	}
+	if u.Scheme != "http" {
+		u.Scheme = "https"
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+/*
+*	Returns the url of database db in account with the account's
+*	username and password in it, the way the replicator is given
+*	the source and target of accounts without an API key.
+ */
+func CredentialsUrl(account cam.CloudantAccount, db string) string {
+	u, err := url.Parse(GetApiUrl(account) + "/" + db)
+	if err != nil {
+		return GetApiUrl(account) + "/" + db
+	}
+	u.User = url.UserPassword(account.Username, account.Password)
+	return u.String()
+}
+
+/*
+*	Returns db as a URL path segment. Database names may contain a
+*	slash, which has to be escaped.
+ */
+func DatabasePath(db string) string {
+	return url.PathEscape(db)
+}
+
+/*
+*	Returns the URL of the document id in database db of account,
+*	escaping ids that contain a slash.
+ */
+func DocumentUrl(account cam.CloudantAccount, db string, id string) string {
+	return GetApiUrl(account) + "/" + db + "/" + url.PathEscape(id)
+}
+
+/*
+*	Looks up the current _rev of the document at docUrl and deletes it.
+*	A missing document counts as a successful delete. Both requests
+*	are retried and re-authenticated like MakeAuthenticatedRequest.
+ */
+func DeleteDocument(docUrl string, httpClient Doer, account cam.CloudantAccount, maxRetries int) HttpResponse {
+	resp, err := MakeAuthenticatedRequest(httpClient, "GET", docUrl, "", nil, account, maxRetries)
+	if err != nil {
+		return HttpResponse{RequestType: "GET", Err: err}
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody)}
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(respBody, &doc)
+	rev, _ := doc["_rev"].(string)
+	if resp.StatusCode != 200 || rev == "" {
+		return HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody),
+			Err: errors.New("Trouble looking up " + docUrl[strings.LastIndex(docUrl, "/")+1:] + " for '" + account.Endpoint + "'")}
+	}
+	resp, err = MakeAuthenticatedRequest(httpClient, "DELETE", docUrl+"?rev="+rev, "", nil, account, maxRetries)
+	if err != nil {
+		return HttpResponse{RequestType: "DELETE", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 404 {
+		err = errors.New("Trouble deleting " + docUrl[strings.LastIndex(docUrl, "/")+1:] + " for '" + account.Endpoint + "'")
+	}
+	return HttpResponse{RequestType: "DELETE", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Adds the credentials that authenticate a request as account to
+*	headers: its IAM bearer token if it has one, its session cookie
+*	otherwise.
+ */
+func AuthHeaders(account cam.CloudantAccount, headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	renewedLock.Lock()
+	account = currentCredentials(account)
+	renewedLock.Unlock()
+	if account.Token != "" {
+		headers["Authorization"] = "Bearer " + account.Token
+	} else {
+		headers["Cookie"] = account.Cookie
+	}
+	return headers
+}
+
+/*
+*	Identifies an account in renewed. Accounts on different hosts can
+*	share a username, so the username alone is not enough.
+ */
+func renewedKey(account cam.CloudantAccount) string {
+	return GetApiUrl(account) + " " + account.Username
+}
+
+/*
+*	Replaces the credentials of account with renewed ones, if any.
+*	renewedLock must be held.
+ */
+func currentCredentials(account cam.CloudantAccount) cam.CloudantAccount {
+	if fresh, ok := renewed[renewedKey(account)]; ok {
+		account.Cookie, account.Token = fresh.Cookie, fresh.Token
+	}
+	return account
+}
+
+/*
+*	Sends a request as account like MakeRequestWithRetry. If Cloudant
+*	answers 401 because the account's session has expired, the account
+*	is authenticated again and the request retried once.
+ */
+func MakeAuthenticatedRequest(httpClient Doer, rType string, url string, body string, headers map[string]string, account cam.CloudantAccount, maxRetries int) (*http.Response, error) {
+	renewedLock.Lock()
+	used := currentCredentials(account)
+	renewedLock.Unlock()
+	resp, err := MakeRequestWithRetry(httpClient, rType, url, body, AuthHeaders(used, headers), maxRetries)
+	if err != nil || resp.StatusCode != 401 || Reauthenticate == nil {
+		return resp, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err = renewCredentials(httpClient, used); err != nil {
+		return nil, err
+	}
+	return MakeRequestWithRetry(httpClient, rType, url, body, AuthHeaders(account, headers), maxRetries)
+}
+
+/*
+*	Authenticates the account whose credentials used were rejected,
+*	unless a concurrent request has renewed them already.
+ */
+func renewCredentials(httpClient Doer, used cam.CloudantAccount) error {
+	renewedLock.Lock()
+	defer renewedLock.Unlock()
+	current := currentCredentials(used)
+	if current.Cookie != used.Cookie || current.Token != used.Token {
+		return nil
+	}
+	fmt.Fprintln(Out, "Session expired for '"+terminal.ColorizeBold(used.Endpoint, 36)+"', authenticating again")
+	fresh, err := Reauthenticate(httpClient, used)
+	if err != nil {
+		return err
+	}
+	renewed[renewedKey(used)] = fresh
+	return nil
+}
+
 /*
 * 	Creates a new http request based on the params and sends it, returning the response.
  */
-func MakeRequest(httpClient *http.Client, rType string, url string, body string, headers map[string]string) (*http.Response, error) {
-	req, _ := http.NewRequest(rType, url, bytes.NewBufferString(body))
+func MakeRequest(httpClient Doer, rType string, url string, body string, headers map[string]string) (*http.Response, error) {
+	return makeRequest(Ctx, httpClient, rType, url, body, headers)
+}
+
+/*
+*	Sends a request like MakeRequest that goes through even after
+*	Ctrl-C, for cleaning up such as deleting session cookies.
+ */
+func MakeCleanupRequest(httpClient Doer, rType string, url string, body string, headers map[string]string) (*http.Response, error) {
+	return makeRequest(context.Background(), httpClient, rType, url, body, headers)
+}
+
+func makeRequest(ctx context.Context, httpClient Doer, rType string, url string, body string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(rType, url, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, errors.New("Unable to build the " + rType + " request, its url is not valid")
+	}
+	req = req.WithContext(ctx)
+	if Limiter != nil {
+		if err := Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
 	for header, value := range headers {
 		req.Header.Set(header, value)
 	}
-	return httpClient.Do(req)
+	if Verbose {
+		logRequest(req, body)
+	}
+	resp, err := httpClient.Do(req)
+	if Verbose {
+		if err != nil {
+			fmt.Fprintln(Out, terminal.ColorizeBold("RESPONSE", 33)+" "+rType+" "+redactUrl(url)+" failed: "+err.Error())
+		} else {
+			fmt.Fprintln(Out, terminal.ColorizeBold("RESPONSE", 33)+" "+rType+" "+redactUrl(url)+" "+resp.Status)
+		}
+	}
+	return resp, err
+}
+
+func logRequest(req *http.Request, body string) {
+	fmt.Fprintln(Out, terminal.ColorizeBold("REQUEST", 33)+" "+req.Method+" "+redactUrl(req.URL.String()))
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names); i++ {
+		value := req.Header.Get(names[i])
+		if IsValid(names[i], redactedHeaders) {
+			value = "[PRIVATE DATA HIDDEN]"
+		}
+		fmt.Fprintln(Out, "  "+names[i]+": "+value)
+	}
+	if body != "" {
+		fmt.Fprintln(Out, RedactBody(indentBody(body)))
+	}
+}
+
+/*
+*	Request bodies are sent compact. This indents a JSON body for
+*	the people reading --verbose or --dry-run output.
+ */
+func indentBody(body string) string {
+	var indented bytes.Buffer
+	if json.Indent(&indented, []byte(body), "", "  ") != nil {
+		return body
+	}
+	return indented.String()
+}
+
+/*
+*	Hides the password of a URL that carries credentials, and the
+*	whole URL if it can't be parsed
+ */
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "[PRIVATE DATA HIDDEN]"
+	}
+	return u.Redacted()
+}
+
+/*
+*	Prints a request that would have been sent, used in place of
+*	MakeRequest during a dry run.
+ */
+func PrintRequest(rType string, url string, body string) {
+	fmt.Fprintln(Out, terminal.ColorizeBold(rType, 33)+" "+url)
+	if body != "" {
+		fmt.Fprintln(Out, RedactBody(indentBody(body)))
+	}
+}
+
+var (
+	urlCredentialsRegexp = regexp.MustCompile(`://([^:/@"]+):[^@/"]+@`)
+	apiKeyRegexp         = regexp.MustCompile(`"api_key":\s*"[^"]*"`)
+	formSecretRegexp     = regexp.MustCompile(`(^|&)(password|apikey)=[^&]*`)
+)
+
+/*
+*	Hides the passwords embedded in urls, the IAM API keys and the
+*	passwords and API keys of login forms in a request body before
+*	it is printed.
+ */
+func RedactBody(body string) string {
+	body = urlCredentialsRegexp.ReplaceAllString(body, "://$1:xxxxx@")
+	body = formSecretRegexp.ReplaceAllString(body, "${1}${2}=xxxxx")
+	return apiKeyRegexp.ReplaceAllString(body, `"api_key": "xxxxx"`)
+}
+
+/*
+*	Sends a request like MakeRequest, retrying with exponential backoff
+*	while Cloudant answers 429 or a 5xx status, at most maxRetries times.
+*	A Retry-After header takes precedence over the computed backoff.
+ */
+func MakeRequestWithRetry(httpClient Doer, rType string, url string, body string, headers map[string]string, maxRetries int) (*http.Response, error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		resp, err := MakeRequest(httpClient, rType, url, body, headers)
+		if err != nil || attempt >= maxRetries || (resp.StatusCode != 429 && resp.StatusCode < 500) {
+			return resp, err
+		}
+		wait := backoff << uint(attempt)
+		if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		select {
+		case <-time.After(wait):
+		case <-Ctx.Done():
+			return nil, Ctx.Err()
+		}
+	}
+}
+
+/*
+*	Collects numCalls responses from the channel, printing the ones that
+*	failed, and returns all of them.
+ */
+func CheckHttpResponses(responses chan HttpResponse, numCalls int) []HttpResponse {
+	return CheckHttpResponsesWithProgress(responses, numCalls, nil)
 }
 
-func CheckHttpResponses(responses chan HttpResponse, numCalls int) {
+/*
+*	Like CheckHttpResponses, but also prints a "[n/numCalls]" line
+*	saying what describe makes of each response as it arrives.
+ */
+func CheckHttpResponsesWithProgress(responses chan HttpResponse, numCalls int, describe func(HttpResponse) string) []HttpResponse {
 	if numCalls < 1 {
-		return
+		return nil
 	}
 	var resp []HttpResponse
 	for {
 		select {
-		case r := <-responses:
+		case r, ok := <-responses:
+			if !ok {
+				// every sender has finished, whatever it managed to send
+				return resp
+			}
 			if CheckErrorNonFatal(r.Err) {
-				fmt.Println(r.RequestType)
-				fmt.Println(r.Status)
-				fmt.Println(r.Body)
+				fmt.Fprintln(Errors, r.RequestType)
+				fmt.Fprintln(Errors, r.Status)
+				if reason := ErrorReason(r.Body); reason != "" {
+					fmt.Fprintln(Errors, "Reason: "+reason)
+				}
 			}
 			resp = append(resp, r)
+			if describe != nil && ShowProgress {
+				fmt.Fprintln(Out, "["+strconv.Itoa(len(resp))+"/"+strconv.Itoa(numCalls)+"] "+describe(r))
+			}
 		case <-time.After(50 * time.Millisecond):
 			continue
 		}
@@ -67,12 +592,84 @@ func CheckHttpResponses(responses chan HttpResponse, numCalls int) {
 			break
 		}
 	}
+	return resp
+}
+
+/*
+*	Deferred by the goroutines that send on responses, so that a panic
+*	is reported as a failed request, based on r, instead of crashing
+*	the plugin or leaving CheckHttpResponses waiting for a response
+*	that never comes.
+ */
+func RecoverResponse(responses chan HttpResponse, r HttpResponse) {
+	if p := recover(); p != nil {
+		r.Err = fmt.Errorf("%s request failed unexpectedly: %v", r.RequestType, p)
+		responses <- r
+	}
+}
+
+/*
+*	Extracts the error and reason from a Cloudant error response such
+*	as {"error":"forbidden","reason":"..."}, returning the body itself
+*	when it is not one.
+ */
+func ErrorReason(body string) string {
+	var cloudantErr struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal([]byte(body), &cloudantErr) != nil || cloudantErr.Error == "" {
+		return strings.TrimSpace(body)
+	}
+	if cloudantErr.Reason == "" {
+		return cloudantErr.Error
+	}
+	return cloudantErr.Error + ": " + cloudantErr.Reason
+}
+
+/*
+*	Prints the failures among responses grouped by the phase they
+*	happened in. Errors that are not a SyncError are listed as other.
+ */
+func PrintFailureSummary(responses []HttpResponse) {
+	var phases []string
+	failures := make(map[string][]string)
+	for i := 0; i < len(responses); i++ {
+		if responses[i].Err == nil {
+			continue
+		}
+		phase, line := "other", terminal.Decolorize(responses[i].Err.Error())
+		if syncErr, ok := responses[i].Err.(*SyncError); ok {
+			phase = syncErr.Phase
+			line = "'" + syncErr.Database + "' in '" + syncErr.Account + "'"
+			if syncErr.Status != "" {
+				line += " (" + syncErr.Status + ")"
+			}
+			if reason := ErrorReason(responses[i].Body); reason != "" {
+				line += ": " + reason
+			}
+		}
+		if _, seen := failures[phase]; !seen {
+			phases = append(phases, phase)
+		}
+		failures[phase] = append(failures[phase], line)
+	}
+	if len(phases) == 0 {
+		return
+	}
+	fmt.Fprintln(Errors, terminal.ColorizeBold("\nFAILURES", 31))
+	for i := 0; i < len(phases); i++ {
+		fmt.Fprintln(Errors, "\n"+terminal.ColorizeBold(phases[i], 36)+" ("+strconv.Itoa(len(failures[phases[i]]))+")")
+		for j := 0; j < len(failures[phases[i]]); j++ {
+			fmt.Fprintln(Errors, "  "+failures[phases[i]][j])
+		}
+	}
 }
 
 func CheckErrorNonFatal(err error) bool {
 	if err != nil {
-		fmt.Println(terminal.ColorizeBold("\nFAILED", 31))
-		fmt.Println(err.Error())
+		fmt.Fprintln(Errors, terminal.ColorizeBold("\nFAILED", 31))
+		fmt.Fprintln(Errors, err.Error())
 		return true
 	}
 	return false
@@ -80,8 +677,8 @@ func CheckErrorNonFatal(err error) bool {
 
 func CheckErrorFatal(err error) {
 	if err != nil {
-		fmt.Println(terminal.ColorizeBold("\nFAILED", 31))
-		fmt.Println(err.Error())
+		fmt.Fprintln(Errors, terminal.ColorizeBold("\nFAILED", 31))
+		fmt.Fprintln(Errors, err.Error())
 		panic(err.Error())
 	}
 
@@ -96,6 +693,28 @@ func IsValid(el string, elements []string) bool {
 	return false
 }
 
+var guidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+/*
+*	Returns the name of the app with the given GUID in the current
+*	org and space. GUIDs differ between regions, so the name is what
+*	the app is looked up by in the other regions.
+ */
+func GetAppNameByGuid(cliConnection plugin.CliConnection, guid string) (string, error) {
+	apps, err := cliConnection.GetApps()
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(apps); i++ {
+		if strings.ToLower(apps[i].Guid) == guid {
+			return apps[i].Name, nil
+		}
+	}
+	endpoint, _ := cliConnection.ApiEndpoint()
+	return "", errors.New("No app with GUID '" + guid + "' at '" + terminal.ColorizeBold(endpoint, 36) +
+		"'.\nTarget the org and space of the app, or pass its name with -a.\n")
+}
+
 func GetAllApps(cliConnection plugin.CliConnection) ([]string, error) {
 	var apps_list []string
 	apps, err := cliConnection.GetApps()
@@ -108,43 +727,77 @@ func GetAllApps(cliConnection plugin.CliConnection) ([]string, error) {
 	return apps_list, nil
 }
 
-func GetDatabases(httpClient *http.Client, account cam.CloudantAccount) []string {
+func GetDatabases(httpClient Doer, account cam.CloudantAccount) []string {
+	dbs, err := ListDatabases(httpClient, account)
+	CheckErrorNonFatal(err)
+	return dbs
+}
+
+/*
+*	Requests all databases for a given Cloudant account, failing
+*	if the account could not be reached
+ */
+func ListDatabases(httpClient Doer, account cam.CloudantAccount) ([]string, error) {
 	var dbs []string
-	url := "https://" + account.Username + ".cloudant.com/_all_dbs"
-	headers := map[string]string{"Cookie": account.Cookie}
+	url := GetApiUrl(account) + "/_all_dbs"
+	headers := AuthHeaders(account, nil)
 	resp, err := MakeRequest(httpClient, "GET", url, "", headers)
-	if CheckErrorNonFatal(err) {
-		return dbs
+	if err != nil {
+		return dbs, err
 	}
 	defer resp.Body.Close()
 	respBody, _ := ioutil.ReadAll(resp.Body)
-	dbsStr := string(respBody)
-	json.Unmarshal([]byte(dbsStr), &dbs)
-	resp.Body.Close()
-	return dbs
+	if resp.StatusCode != 200 {
+		return dbs, errors.New("Unable to list the databases in '" + terminal.ColorizeBold(account.Endpoint, 36) + "' (" + resp.Status + ")")
+	}
+	json.Unmarshal(respBody, &dbs)
+	return dbs, nil
 }
 
 /*
 *	Requests all databases for a given Cloudant account
 *	and returns them as a string array
  */
-func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) []string {
-	var all_dbs []string
-	db_ch := make(chan []string)
+func GetAllDatabases(httpClient Doer, cloudantAccounts []cam.CloudantAccount) []string {
+	all_dbs, _ := ListAllDatabases(httpClient, cloudantAccounts)
+	return all_dbs
+}
+
+/*
+*	Requests the databases of every account at once and merges them.
+*	Also returns the endpoints of the accounts that answered, so that
+*	callers can tell an empty list from one nobody could provide. The
+*	number of databases in each account is printed so that accounts
+*	missing some of them stand out.
+ */
+func ListAllDatabases(httpClient Doer, cloudantAccounts []cam.CloudantAccount) ([]string, []string) {
+	type listing struct {
+		endpoint string
+		dbs      []string
+		err      error
+	}
+	var all_dbs, listed_by []string
+	counts := make(map[string]int)
+	db_ch := make(chan listing)
 	for i := 0; i < len(cloudantAccounts); i++ {
-		go func(httpClient *http.Client, account cam.CloudantAccount) {
-			dbs := GetDatabases(httpClient, account)
-			db_ch <- dbs
+		go func(httpClient Doer, account cam.CloudantAccount) {
+			dbs, err := ListDatabases(httpClient, account)
+			db_ch <- listing{endpoint: account.Endpoint, dbs: dbs, err: err}
 		}(httpClient, cloudantAccounts[i])
 	}
 	num_responses := 0
 	for {
 		select {
-		case dbs := <-db_ch:
-			if len(dbs) != 0 {
-				for j := 0; j < len(dbs); j++ {
-					if dbs[j] != "_replicator" && !IsValid(dbs[j], all_dbs) {
-						all_dbs = append(all_dbs, dbs[j])
+		case l := <-db_ch:
+			if !CheckErrorNonFatal(l.err) {
+				listed_by = append(listed_by, l.endpoint)
+				for j := 0; j < len(l.dbs); j++ {
+					if l.dbs[j] == "_replicator" || strings.HasSuffix(l.dbs[j], "/_replicator") {
+						continue
+					}
+					counts[l.endpoint] += 1
+					if !IsValid(l.dbs[j], all_dbs) {
+						all_dbs = append(all_dbs, l.dbs[j])
 					}
 				}
 			}
@@ -156,38 +809,594 @@ func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAcc
 			break
 		}
 	}
-	return all_dbs
+	if len(listed_by) > 1 {
+		for i := 0; i < len(listed_by); i++ {
+			line := strconv.Itoa(counts[listed_by[i]]) + " databases in '" + terminal.ColorizeBold(listed_by[i], 36) + "'"
+			if missing := len(all_dbs) - counts[listed_by[i]]; missing > 0 {
+				line += terminal.ColorizeBold(", missing "+strconv.Itoa(missing)+" found elsewhere", 33)
+			}
+			fmt.Fprintln(Out, line)
+		}
+		fmt.Fprintln(Out)
+	}
+	return all_dbs, listed_by
 }
 
-func HandleFlags(args []string) (string, []string, string, bool, bool) {
-	var appname, password string
-	var dbs []string
-	all_dbs := false
-	create := false
-	err := errors.New("Problem with command invocation. For help look to '" +
-		terminal.ColorizeBold("cf help cloudant-replicate", 33) + "'")
+type Flags struct {
+	AppName           string
+	Dbs               []string
+	Password          string
+	AllDbs            bool
+	Create            bool
+	Revoke            bool
+	DryRun            bool
+	Json              bool
+	PasswordStdin     bool
+	Once              bool
+	Timeout           int
+	MaxRetries        int
+	Regions           []string
+	Exclude           []string
+	IncludeSystem     bool
+	Verbose           bool
+	Concurrency       int
+	ApiKey            string
+	WorkerProcesses   int
+	ConnectionTimeout int
+	Filter            string
+	QueryParams       map[string]interface{}
+	Yes               bool
+	Config            string
+	Quiet             bool
+	DbMap             map[string]string
+	Cache             time.Duration
+	DbFile            string
+	ApiEndpoints      []string
+	OnlyEndpoints     bool
+	OnlyPermissions   bool
+	SkipPermissions   bool
+	Proxy             *url.URL
+	IdPrefix          string
+	Verify            bool
+	Topology          string
+	Hub               string
+	Rps               int
+	SourceRegion      string
+	Report            string
+	Apps              []string
+	NoColor           bool
+	NoCheckpoints     bool
+	SinceSeq          string
+	Interval          int
+	MaxWait           int
+	ParallelDbs       bool
+	Deadline          time.Duration
+	NoDdocs           bool
+	GrantAs           map[string]string
+	Insecure          bool
+	Owner             string
+	Match             string
+	Resume            bool
+	CleanupOnFailure  bool
+	PushFilter        string
+	PullFilter        string
+	PushOnce          bool
+	PullOnce          bool
+	AllowPartial      bool
+	LoginTimeout      int
+	ReplicatorDb      string
+	ListFrom          string
+	ReplicatorOptions map[string]interface{}
+	Estimate          bool
+	KeepSession       bool
+	AppGuid           string
+	Events            bool
+	GrantRoles        []string
+	ParallelAccounts  int
+	NewOnly           bool
+	Wait              bool
+	ConfirmPassword   bool
+}
+
+/*
+*	Returns the settings used for every flag that is not passed
+ */
+func DefaultFlags() Flags {
+	return Flags{Timeout: 60, MaxRetries: 3, Concurrency: 8, Interval: 5, MaxWait: 600, LoginTimeout: 30, ReplicatorDb: "_replicator",
+		GrantRoles: []string{"_reader", "_replicator"}}
+}
+
+func HandleFlags(args []string) Flags {
+	flags := DefaultFlags()
 	for i := 1; i < len(args); i++ {
 		switch args[i] {
 		case "-a":
-			if i+1 >= len(args) {
-				CheckErrorFatal(err)
+			flags.AppName = flagValue(args, i)
+		case "--apps":
+			flags.Apps = splitList(flagValue(args, i))
+		case "--app-guid":
+			flags.AppGuid = strings.ToLower(flagValue(args, i))
+			if !guidRegexp.MatchString(flags.AppGuid) {
+				CheckErrorFatal(errors.New("'" + args[i+1] + "' is not a valid app GUID, e.g. 8f1b7c4e-2d3a-4b5c-9e6f-0a1b2c3d4e5f"))
 			}
-			appname = args[i+1]
 		case "-d":
-			if i+1 >= len(args) {
-				CheckErrorFatal(err)
-			}
-			dbs = strings.Split(args[i+1], ",")
+			flags.Dbs = splitList(flagValue(args, i))
 		case "-p":
-			if i+1 >= len(args) {
-				CheckErrorFatal(err)
+			flags.Password = flagValue(args, i)
+		case "-r":
+			flags.Regions = splitList(flagValue(args, i))
+		case "--timeout":
+			flags.Timeout = intFlag(args, i, 1)
+		case "--max-retries":
+			flags.MaxRetries = intFlag(args, i, 0)
+		case "--concurrency":
+			flags.Concurrency = intFlag(args, i, 1)
+		case "--parallel-accounts":
+			flags.ParallelAccounts = intFlag(args, i, 1)
+		case "--rps":
+			flags.Rps = intFlag(args, i, 1)
+		case "--worker-processes":
+			flags.WorkerProcesses = intFlag(args, i, 1)
+		case "--connection-timeout":
+			flags.ConnectionTimeout = intFlag(args, i, 1)
+		case "--filter":
+			flags.Filter = normalizeFilter(flagValue(args, i))
+		case "--push-filter":
+			flags.PushFilter = normalizeFilter(flagValue(args, i))
+		case "--pull-filter":
+			flags.PullFilter = normalizeFilter(flagValue(args, i))
+		case "--push-once":
+			flags.PushOnce = true
+		case "--pull-once":
+			flags.PullOnce = true
+		case "--replicator-option":
+			if flags.ReplicatorOptions == nil {
+				flags.ReplicatorOptions = make(map[string]interface{})
 			}
-			password = args[i+1]
-		case "--all-dbs":
-			all_dbs = true
+			key, value := parseReplicatorOption(flagValue(args, i))
+			flags.ReplicatorOptions[key] = value
+		case "--query-params":
+			if json.Unmarshal([]byte(flagValue(args, i)), &flags.QueryParams) != nil {
+				CheckErrorFatal(errors.New("--query-params must be a JSON object"))
+			}
+		case "--all-dbs", "--all", "--databases-all":
+			flags.AllDbs = true
 		case "--create":
-			create = true
+			flags.Create = true
+		case "--revoke":
+			flags.Revoke = true
+		case "--dry-run":
+			flags.DryRun = true
+		case "--apikey":
+			flags.ApiKey = flagValue(args, i)
+		case "--config":
+			flags.Config = flagValue(args, i)
+		case "--api-endpoint":
+			endpoint := strings.TrimSuffix(flagValue(args, i), "/")
+			if u, parseErr := url.Parse(endpoint); parseErr != nil || u.Scheme != "https" || u.Host == "" {
+				CheckErrorFatal(errors.New("'" + args[i+1] + "' is not a valid API endpoint. Use an https URL, e.g. https://api.us-east.bluemix.net"))
+			}
+			if !IsValid(endpoint, flags.ApiEndpoints) {
+				flags.ApiEndpoints = append(flags.ApiEndpoints, endpoint)
+			}
+		case "--topology":
+			flags.Topology = flagValue(args, i)
+			if flags.Topology != "mesh" && flags.Topology != "hub" {
+				CheckErrorFatal(errors.New("--topology must be mesh or hub"))
+			}
+		case "--report":
+			flags.Report = flagValue(args, i)
+		case "--source-region":
+			flags.SourceRegion = flagValue(args, i)
+		case "--hub":
+			flags.Hub = flagValue(args, i)
+		case "--id-prefix":
+			flags.IdPrefix = flagValue(args, i)
+		case "--proxy":
+			proxy, parseErr := url.Parse(flagValue(args, i))
+			if parseErr != nil || proxy.Host == "" || !IsValid(proxy.Scheme, []string{"http", "https", "socks5"}) {
+				CheckErrorFatal(errors.New("'" + args[i+1] + "' is not a valid proxy. Use an http, https or socks5 URL, e.g. http://proxy.example.com:8080"))
+			}
+			flags.Proxy = proxy
+		case "--only-permissions":
+			flags.OnlyPermissions = true
+		case "--skip-permissions":
+			flags.SkipPermissions = true
+		case "--only-endpoints":
+			flags.OnlyEndpoints = true
+		case "--db-file":
+			flags.DbFile = flagValue(args, i)
+		case "--cache":
+			ttl, parseErr := time.ParseDuration(flagValue(args, i))
+			if parseErr != nil || ttl <= 0 {
+				CheckErrorFatal(errors.New("--cache must be a positive duration such as 30m or 12h"))
+			}
+			flags.Cache = ttl
+		case "--deadline":
+			deadline, parseErr := time.ParseDuration(flagValue(args, i))
+			if parseErr != nil || deadline <= 0 {
+				CheckErrorFatal(errors.New("--deadline must be a positive duration such as 90s or 10m"))
+			}
+			flags.Deadline = deadline
+		case "--grant-as":
+			flags.GrantAs = parseGrantAs(flagValue(args, i))
+		case "--grant-roles":
+			flags.GrantRoles = parseGrantRoles(flagValue(args, i))
+		case "--db-map":
+			flags.DbMap = parseDbMap(flagValue(args, i))
+		case "--exclude":
+			flags.Exclude = splitList(flagValue(args, i))
+		case "--no-color":
+			flags.NoColor = true
+		case "-v", "--verbose":
+			flags.Verbose = true
+		case "--include-system":
+			flags.IncludeSystem = true
+		case "-q", "--quiet":
+			flags.Quiet = true
+		case "--json":
+			flags.Json = true
+		case "--password-stdin":
+			flags.PasswordStdin = true
+		case "--confirm-password":
+			flags.ConfirmPassword = true
+		case "--parallel-dbs":
+			flags.ParallelDbs = true
+		case "--once":
+			flags.Once = true
+		case "--interval":
+			flags.Interval = intFlag(args, i, 1)
+		case "--max-wait":
+			flags.MaxWait = intFlag(args, i, 1)
+		case "--insecure":
+			flags.Insecure = true
+		case "--cleanup-on-failure":
+			flags.CleanupOnFailure = true
+		case "--allow-partial":
+			flags.AllowPartial = true
+		case "--login-timeout":
+			flags.LoginTimeout = intFlag(args, i, 1)
+		case "--list-from":
+			flags.ListFrom = flagValue(args, i)
+		case "--replicator-db":
+			flags.ReplicatorDb = flagValue(args, i)
+		case "--resume":
+			flags.Resume = true
+		case "--new-only":
+			flags.NewOnly = true
+		case "--wait":
+			flags.Wait = true
+		case "--events":
+			flags.Events = true
+		case "--estimate":
+			flags.Estimate = true
+		case "--keep-session":
+			flags.KeepSession = true
+		case "--match":
+			flags.Match = flagValue(args, i)
+		case "--owner":
+			flags.Owner = flagValue(args, i)
+		case "--no-ddocs":
+			flags.NoDdocs = true
+		case "--no-checkpoints":
+			flags.NoCheckpoints = true
+		case "--since-seq":
+			flags.SinceSeq = flagValue(args, i)
+		case "--verify":
+			flags.Verify = true
+		case "-y", "--yes":
+			flags.Yes = true
+		}
+	}
+	if flags.ApiKey == "" {
+		flags.ApiKey = os.Getenv("CLOUDANT_SYNC_APIKEY")
+	}
+	if flags.Topology == "hub" && flags.Hub == "" {
+		CheckErrorFatal(errors.New("--topology hub requires --hub REGION"))
+	}
+	if flags.Hub != "" && flags.Topology != "hub" {
+		CheckErrorFatal(errors.New("--hub can only be used with --topology hub"))
+	}
+	if flags.SourceRegion != "" && flags.Topology != "" {
+		CheckErrorFatal(errors.New("--source-region cannot be combined with --topology"))
+	}
+	if flags.Match != "" && flags.AllDbs {
+		CheckErrorFatal(errors.New("--match cannot be combined with --all-dbs"))
+	}
+	if _, err := path.Match(flags.Match, ""); err != nil {
+		CheckErrorFatal(errors.New("--match is not a valid pattern: '" + flags.Match + "'"))
+	}
+	// both would be printed to stdout
+	if flags.Events && flags.Json {
+		CheckErrorFatal(errors.New("--events and --json cannot be used together"))
+	}
+	if flags.AppGuid != "" && (flags.AppName != "" || len(flags.Apps) > 0) {
+		CheckErrorFatal(errors.New("--app-guid cannot be combined with -a or --apps"))
+	}
+	if flags.OnlyPermissions && flags.SkipPermissions {
+		CheckErrorFatal(errors.New("--only-permissions and --skip-permissions cannot be used together"))
+	}
+	if flags.OnlyEndpoints && len(flags.ApiEndpoints) == 0 {
+		CheckErrorFatal(errors.New("--only-endpoints requires at least one --api-endpoint"))
+	}
+	if os.Getenv("CF_TRACE") == "true" {
+		flags.Verbose = true
+	}
+	filtered := flags.Filter != "" || flags.PushFilter != "" || flags.PullFilter != ""
+	if flags.QueryParams != nil && !filtered {
+		CheckErrorFatal(errors.New("--query-params requires --filter"))
+	}
+	// the replicator rejects documents with both a filter and a selector
+	if flags.NoDdocs && filtered {
+		CheckErrorFatal(errors.New("--no-ddocs cannot be combined with --filter"))
+	}
+	// only the hub tells which way a replication goes
+	if (flags.PushFilter != "" || flags.PullFilter != "" || flags.PushOnce || flags.PullOnce) && flags.Topology != "hub" {
+		CheckErrorFatal(errors.New("--push-filter, --pull-filter, --push-once and --pull-once require --topology hub"))
+	}
+	// a continuous replication only starts from since_seq the first time
+	if flags.SinceSeq != "" && !flags.Once {
+		fmt.Fprintln(Errors, terminal.ColorizeBold("WARNING", 33)+" --since-seq is meant for one-time replications with --once."+
+			" A continuous replication only honors it when it first starts.")
+	}
+	if flags.DbFile != "" {
+		fileDbs, fileErr := ReadDatabaseFile(flags.DbFile)
+		CheckErrorFatal(fileErr)
+		for i := 0; i < len(fileDbs); i++ {
+			if !IsValid(fileDbs[i], flags.Dbs) {
+				flags.Dbs = append(flags.Dbs, fileDbs[i])
+			}
+		}
+	}
+	CheckErrorFatal(ValidateDatabaseNames(flags.Dbs, flags.IncludeSystem))
+	if flags.ReplicatorDb != "_replicator" {
+		CheckErrorFatal(ValidateDatabaseNames([]string{flags.ReplicatorDb}, false))
+		// the replicator only watches databases named like this
+		if !strings.HasSuffix(flags.ReplicatorDb, "/_replicator") {
+			CheckErrorFatal(errors.New("--replicator-db must end in /_replicator, e.g. ops/_replicator"))
+		}
+	}
+	return flags
+}
+
+/*
+*	Reads database names from a file, one per line. Blank lines
+*	and lines starting with # are skipped, as are repeated names.
+ */
+func ReadDatabaseFile(path string) ([]string, error) {
+	var dbs []string
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return dbs, err
+	}
+	lines := strings.Split(string(contents), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && !strings.HasPrefix(line, "#") && !IsValid(line, dbs) {
+			dbs = append(dbs, line)
+		}
+	}
+	return dbs, nil
+}
+
+/*
+*	Accepts a filter either as DDOC/FILTER or as the path of the filter
+*	function, _design/DDOC/filters/FILTER, and returns it as DDOC/FILTER
+ */
+func normalizeFilter(filter string) string {
+	parts := strings.Split(strings.TrimPrefix(filter, "_design/"), "/")
+	if len(parts) == 3 && parts[1] == "filters" {
+		parts = []string{parts[0], parts[2]}
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		CheckErrorFatal(errors.New("'" + filter + "' is not a valid filter. Use DDOC/FILTER, e.g. app/active"))
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+/*
+*	Parses a --replicator-option KEY=VALUE pair. Values that are
+*	valid JSON, such as numbers and booleans, keep their type and
+*	anything else is taken as a string.
+ */
+func parseReplicatorOption(option string) (string, interface{}) {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		CheckErrorFatal(errors.New("'" + option + "' is not a valid --replicator-option. Use KEY=VALUE, e.g. checkpoint_interval=30000"))
+	}
+	key := strings.TrimSpace(parts[0])
+	// these are set by the plugin itself, or by --once
+	if strings.HasPrefix(key, "_") || IsValid(key, []string{"source", "target", "create_target", "continuous"}) {
+		CheckErrorFatal(errors.New("--replicator-option cannot set '" + key + "', which the plugin manages"))
+	}
+	var value interface{}
+	if json.Unmarshal([]byte(parts[1]), &value) != nil {
+		value = parts[1]
+	}
+	return key, value
+}
+
+/*
+*	Parses --db-map's comma-separated REGION:DATABASE pairs
+ */
+func parseDbMap(value string) map[string]string {
+	dbMap := make(map[string]string)
+	var names []string
+	pairs := splitList(value)
+	for i := 0; i < len(pairs); i++ {
+		parts := strings.SplitN(pairs[i], ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			CheckErrorFatal(errors.New("'" + pairs[i] + "' is not a valid --db-map entry. Use REGION:DATABASE, e.g. eu-gb:usersdb_eu"))
+		}
+		dbMap[parts[0]] = parts[1]
+		names = append(names, parts[1])
+	}
+	CheckErrorFatal(ValidateDatabaseNames(names, false))
+	return dbMap
+}
+
+// the roles of the cloudant section of a _security document
+var cloudantRoles = []string{"_reader", "_writer", "_replicator", "_admin", "_db_updates", "_design", "_security"}
+
+/*
+*	Parses --grant-roles's comma-separated roles, dropping repeated ones
+ */
+func parseGrantRoles(value string) []string {
+	var roles []string
+	list := splitList(value)
+	for i := 0; i < len(list); i++ {
+		if !IsValid(list[i], cloudantRoles) {
+			CheckErrorFatal(errors.New("'" + list[i] + "' is not a Cloudant role. Use any of " + strings.Join(cloudantRoles, ", ")))
+		}
+		if !IsValid(list[i], roles) {
+			roles = append(roles, list[i])
+		}
+	}
+	if len(roles) == 0 {
+		CheckErrorFatal(errors.New("--grant-roles requires at least one role, e.g. _reader,_replicator"))
+	}
+	return roles
+}
+
+/*
+*	Parses --grant-as's comma-separated REGION:PRINCIPAL pairs
+ */
+func parseGrantAs(value string) map[string]string {
+	grantAs := make(map[string]string)
+	pairs := splitList(value)
+	for i := 0; i < len(pairs); i++ {
+		parts := strings.SplitN(pairs[i], ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			CheckErrorFatal(errors.New("'" + pairs[i] + "' is not a valid --grant-as entry. Use REGION:PRINCIPAL, e.g. eu-gb:apikey-v2-abc123"))
+		}
+		grantAs[parts[0]] = parts[1]
+	}
+	return grantAs
+}
+
+/*
+*	Splits a comma-separated flag value, trimming the spaces around
+*	each entry and dropping empty ones, so "db1, db2,,db3 " gives
+*	db1, db2 and db3
+ */
+func splitList(value string) []string {
+	var list []string
+	entries := strings.Split(value, ",")
+	for i := 0; i < len(entries); i++ {
+		if entry := strings.TrimSpace(entries[i]); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+/*
+*	Returns the value following the flag at args[i], failing with
+*	a usage hint when the flag is the last argument.
+ */
+func flagValue(args []string, i int) string {
+	if i+1 >= len(args) {
+		CheckErrorFatal(errors.New("Missing value for " + args[i] + ". For help look to '" +
+			terminal.ColorizeBold("cf help "+args[0], 33) + "'"))
+	}
+	return args[i+1]
+}
+
+/*
+*	Parses the number following the flag at args[i], failing
+*	unless it is at least min.
+ */
+func intFlag(args []string, i int, min int) int {
+	value, err := strconv.Atoi(flagValue(args, i))
+	if err != nil || value < min {
+		if min > 0 {
+			CheckErrorFatal(errors.New(args[i] + " must be a positive number"))
+		}
+		CheckErrorFatal(errors.New(args[i] + " must be zero or a positive number"))
+	}
+	return value
+}
+
+var dbNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_$()+/-]*$`)
+
+/*
+*	Checks database names against Cloudant's naming rules: a lowercase
+*	letter followed by lowercase letters, digits and any of _$()+-/.
+*	With includeSystem the names of system databases, such as _users,
+*	which are otherwise valid names with a leading underscore, are
+*	accepted too.
+ */
+func ValidateDatabaseNames(dbs []string, includeSystem bool) error {
+	var invalid []string
+	system := false
+	for i := 0; i < len(dbs); i++ {
+		name := dbs[i]
+		if strings.HasPrefix(name, "_") {
+			system = true
+			if includeSystem {
+				name = name[1:]
+			}
+		}
+		if !dbNameRegexp.MatchString(name) {
+			invalid = append(invalid, "'"+dbs[i]+"'")
+		}
+	}
+	if len(invalid) > 0 {
+		msg := "Invalid database name(s): " + strings.Join(invalid, ", ") +
+			"\nNames must start with a lowercase letter and contain only lowercase letters, digits and _$()+-/"
+		if system && !includeSystem {
+			msg += "\nSystem databases such as _users can only be passed with --include-system"
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+/*
+*	Tells whether f is an interactive terminal rather
+*	than a pipe or a file
+ */
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+/*
+*	Returns the region identifier of a Bluemix API endpoint,
+*	e.g. "eu-gb" for "https://api.eu-gb.bluemix.net"
+ */
+func GetRegion(endpoint string) string {
+	region := strings.TrimPrefix(endpoint, "https://")
+	region = strings.TrimPrefix(region, "api.")
+	return strings.TrimSuffix(region, ".bluemix.net")
+}
+
+/*
+*	Restricts endpoints to the given region identifiers. An empty
+*	list of regions leaves the endpoints untouched.
+ */
+func FilterEndpoints(endpoints []string, regions []string) ([]string, error) {
+	if len(regions) == 0 {
+		return endpoints, nil
+	}
+	var valid, filtered []string
+	for i := 0; i < len(endpoints); i++ {
+		valid = append(valid, GetRegion(endpoints[i]))
+	}
+	for i := 0; i < len(regions); i++ {
+		found := false
+		for j := 0; j < len(endpoints); j++ {
+			if regions[i] == valid[j] {
+				found = true
+				if !IsValid(endpoints[j], filtered) {
+					filtered = append(filtered, endpoints[j])
+				}
+			}
+		}
+		if !found {
+			return filtered, errors.New("'" + regions[i] + "' is not a valid region. Valid regions are: " +
+				strings.Join(valid, ", "))
 		}
 	}
-	return appname, dbs, password, all_dbs, create
+	return filtered, nil
 }